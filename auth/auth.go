@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Clever/http-science/config"
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+)
+
+// DefaultRefreshInterval is how often token files are re-read and token commands re-run unless configured
+const DefaultRefreshInterval = 5 * time.Minute
+
+// Provider sets fresh credentials on requests. A nil Provider doesn't change anything
+type Provider struct {
+	header   string
+	prefix   string
+	source   string
+	load     func() (string, error)
+	interval time.Duration
+	now      func() time.Time
+
+	mutex    *sync.Mutex
+	token    string
+	loadedAt time.Time
+	// refreshing is true while a request is loading the token again, so the others keep using the current one
+	refreshing bool
+}
+
+// New returns a Provider for the auth config, or nil if it is empty. The token is loaded
+// straight away so a broken config fails before any requests are sent
+func New(a config.Auth) (*Provider, error) {
+	if a.IsEmpty() {
+		return nil, nil
+	}
+	p := &Provider{
+		header:   a.Header,
+		prefix:   a.Prefix,
+		interval: time.Duration(a.RefreshInterval) * time.Second,
+		now:      time.Now,
+		mutex:    &sync.Mutex{},
+	}
+	if p.header == "" {
+		p.header = "Authorization"
+	}
+	if p.interval == 0 {
+		p.interval = DefaultRefreshInterval
+	}
+	switch {
+	case a.Env != "":
+		p.source = "env " + a.Env
+		p.load = func() (string, error) { return os.Getenv(a.Env), nil }
+		// The environment doesn't change while we run
+		p.interval = -1
+	case a.File != "":
+		p.source = "file " + a.File
+		p.load = func() (string, error) {
+			buf, err := ioutil.ReadFile(a.File)
+			return string(buf), err
+		}
+	default:
+		p.source = "command " + a.Command
+		p.load = func() (string, error) { return runCommand(a.Command) }
+	}
+	if _, err := p.credentials(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Authorize sets the credentials header on the request, replacing any captured credentials
+func (p *Provider) Authorize(r *http.Request) error {
+	if p == nil {
+		return nil
+	}
+	token, err := p.credentials()
+	if err != nil {
+		return err
+	}
+	r.Header.Set(p.header, p.prefix+token)
+	return nil
+}
+
+// credentials returns the token, loading it again if it is older than the refresh interval. Only one
+// request refreshes it at a time, without holding the lock, so a slow command doesn't hold up the others.
+// If a refresh fails the previous token is kept until the next one
+func (p *Provider) credentials() (string, error) {
+	p.mutex.Lock()
+	if p.token != "" && (p.refreshing || p.interval < 0 || p.now().Sub(p.loadedAt) < p.interval) {
+		token := p.token
+		p.mutex.Unlock()
+		return token, nil
+	}
+	p.refreshing = true
+	p.mutex.Unlock()
+
+	token, err := p.load()
+	token = strings.TrimSpace(token)
+	if err == nil && token == "" {
+		err = errors.New("token is empty")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.refreshing = false
+	if err != nil {
+		err = fmt.Errorf("error loading credentials from %s: %s", p.source, err)
+		if p.token == "" {
+			return "", err
+		}
+		config.KV.ErrorD("refreshing-credentials-failed", logger.M{"err": err.Error()})
+		// Try again after another interval rather than on every request
+		p.loadedAt = p.now()
+		return p.token, nil
+	}
+	p.token, p.loadedAt = token, p.now()
+	return p.token, nil
+}
+
+func runCommand(command string) (string, error) {
+	out, err := exec.Command("sh", "-c", command).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return string(out), err
+}
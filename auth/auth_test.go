@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+)
+
+func TestNew(t *testing.T) {
+	p, err := New(config.Auth{})
+	assert.Nil(t, err)
+	assert.Nil(t, p)
+	// A nil provider leaves requests alone
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer captured")
+	assert.Nil(t, p.Authorize(r))
+	assert.Equal(t, "Bearer captured", r.Header.Get("Authorization"))
+
+	os.Setenv("HTTP_SCIENCE_TEST_TOKEN", "abc\n")
+	defer os.Unsetenv("HTTP_SCIENCE_TEST_TOKEN")
+	p, err = New(config.Auth{Env: "HTTP_SCIENCE_TEST_TOKEN", Prefix: "Bearer "})
+	assert.Nil(t, err)
+	assert.Nil(t, p.Authorize(r))
+	assert.Equal(t, "Bearer abc", r.Header.Get("Authorization"))
+
+	p, err = New(config.Auth{Command: "printf xyz", Header: "X-Api-Key"})
+	assert.Nil(t, err)
+	assert.Nil(t, p.Authorize(r))
+	assert.Equal(t, "xyz", r.Header.Get("X-Api-Key"))
+
+	_, err = New(config.Auth{Env: "HTTP_SCIENCE_TEST_UNSET"})
+	assert.EqualError(t, err, "error loading credentials from env HTTP_SCIENCE_TEST_UNSET: token is empty")
+	_, err = New(config.Auth{Command: "echo denied >&2; exit 1"})
+	assert.EqualError(t, err, "error loading credentials from command echo denied >&2; exit 1: exit status 1: denied")
+}
+
+func TestRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("one"), 0600))
+
+	p, err := New(config.Auth{File: file, RefreshInterval: 60})
+	assert.Nil(t, err)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	token := func() string {
+		r := httptest.NewRequest("GET", "/", nil)
+		assert.Nil(t, p.Authorize(r))
+		return r.Header.Get("Authorization")
+	}
+
+	assert.Nil(t, ioutil.WriteFile(file, []byte("two"), 0600))
+	assert.Equal(t, "one", token())
+	now = now.Add(time.Minute)
+	assert.Equal(t, "two", token())
+
+	// A failed refresh keeps the previous token
+	assert.Nil(t, os.Remove(file))
+	now = now.Add(time.Minute)
+	assert.Equal(t, "two", token())
+}
+
+func TestRefreshDoesntBlock(t *testing.T) {
+	p, err := New(config.Auth{Command: "echo one", RefreshInterval: 60})
+	assert.Nil(t, err)
+	now := time.Now().Add(time.Minute)
+	p.now = func() time.Time { return now }
+	started, done := make(chan struct{}), make(chan struct{})
+	p.load = func() (string, error) {
+		close(started)
+		<-done
+		return "two", nil
+	}
+	token := func() string {
+		r := httptest.NewRequest("GET", "/", nil)
+		assert.Nil(t, p.Authorize(r))
+		return r.Header.Get("Authorization")
+	}
+
+	refreshed := make(chan string)
+	go func() { refreshed <- token() }()
+	<-started
+	// Other requests keep the current token while the command runs
+	assert.Equal(t, "one", token())
+	close(done)
+	assert.Equal(t, "two", <-refreshed)
+	assert.Equal(t, "two", token())
+}
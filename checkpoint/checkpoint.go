@@ -0,0 +1,78 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"gopkg.in/Clever/pathio.v3"
+
+	"github.com/Clever/http-science/science"
+)
+
+// Checkpoint is the progress of a job, saved periodically so a restarted job can resume
+type Checkpoint struct {
+	Time time.Time `json:"time"`
+	// ProcessedFiles are the remote capture files that have been replayed in full
+	ProcessedFiles []string `json:"processed_files"`
+	// CurrentFile is the remote capture file being replayed, and CurrentFileOffset the
+	// number of its requests that were replayed
+	CurrentFile       string `json:"current_file"`
+	CurrentFileOffset int    `json:"current_file_offset"`
+	// DiffLogChunks are the diff log chunks uploaded so far
+	DiffLogChunks []string        `json:"diff_log_chunks"`
+	Results       science.Results `json:"results"`
+}
+
+// Save writes the checkpoint to loc. The caller must hold science.Res.Mutex if Results is science.Res
+func Save(loc string, c *Checkpoint) error {
+	buf, err := Encode(c)
+	if err != nil {
+		return err
+	}
+	return Write(loc, buf)
+}
+
+// Encode encodes the checkpoint, so it can be taken holding science.Res.Mutex and written after unlocking
+func Encode(c *Checkpoint) ([]byte, error) {
+	return json.Marshal(c)
+}
+
+// Write writes an encoded checkpoint to loc
+func Write(loc string, buf []byte) error {
+	return pathio.Write(loc, buf)
+}
+
+// Load reads the checkpoint at loc. It returns nil if there is no checkpoint there yet, so the
+// first run of a job can be resumed the same way as the restarts
+func Load(loc string) (*Checkpoint, error) {
+	reader, err := pathio.Reader(loc)
+	if notExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	c := &Checkpoint{}
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// notExist returns true if err is from reading a local file or S3 object that doesn't exist
+func notExist(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	// S3 errors have a code, see awserr.Error
+	if awsErr, ok := err.(interface{ Code() string }); ok {
+		return awsErr.Code() == "NoSuchKey"
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/science"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	loc := filepath.Join(dir, "checkpoint.json")
+
+	latency := &science.Latency{}
+	latency.Add(time.Second)
+	c := &Checkpoint{
+		Time:              time.Date(2016, 5, 31, 23, 0, 0, 0, time.UTC),
+		ProcessedFiles:    []string{"s3://bucket/2016/05/31/22/a.gz"},
+		CurrentFile:       "s3://bucket/2016/05/31/23/b.gz",
+		CurrentFileOffset: 12,
+		DiffLogChunks:     []string{"s3://bucket/diffs.00001"},
+		Results: science.Results{
+			Reqs:     40,
+			Received: 42,
+			Mutex:    &sync.Mutex{},
+			Diffs:    3,
+			Codes:    map[int]map[int]int{500: {200: 3}},
+			Routes: map[string]*science.RouteStats{
+				"GET /v1/users/:id": {Reqs: 40, Diffs: 3, Latency: latency, ControlLatency: &science.Latency{}},
+			},
+			// The diffs sampled with diff_sample_size are only written at the end, so they are saved here
+			Samples: map[string]*science.DiffSample{
+				"GET /v1/users/:id 500 200": {Seen: 3, Diffs: []science.Diff{
+					{Route: "GET /v1/users/:id", ControlCode: 500, ExperimentCode: 200, Fields: []string{"body"}, Request: "req"},
+				}},
+			},
+			DroppedDiffs: 2,
+		},
+	}
+	assert.Nil(t, Save(loc, c))
+
+	loaded, err := Load(loc)
+	assert.Nil(t, err)
+	// The mutex and diff log aren't saved
+	c.Results.Mutex = nil
+	assert.Equal(t, c, loaded)
+}
+
+type s3Error string
+
+func (e s3Error) Error() string { return string(e) }
+func (e s3Error) Code() string  { return string(e) }
+
+func TestLoadMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The first run of a resumable job starts fresh
+	c, err := Load(filepath.Join(dir, "checkpoint.json"))
+	assert.Nil(t, err)
+	assert.Nil(t, c)
+	assert.True(t, notExist(s3Error("NoSuchKey")))
+	assert.False(t, notExist(s3Error("AccessDenied")))
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/getfiles"
+	"github.com/Clever/http-science/science"
+	"github.com/Clever/http-science/validate"
+	"gopkg.in/Clever/pathio.v3"
+)
+
+const usage = `Usage:
+  http-science '<json payload>'
+  http-science <command> [flags]
+
+Commands:
+  correctness       Run a correctness test
+  load              Run a load test
+  record            Proxy traffic to a service, recording it into capture files to replay
+  validate-payload  Validate a payload and print it with the defaults filled in
+  list-files        List the capture files that would be replayed
+  compare-dumps     Compare two raw HTTP responses, e.g. copied from a diff log
+
+Every payload field can be set with a flag named after it, e.g. -service-name for
+service_name. List fields are comma separated. A payload can also be loaded with
+-payload-file <path>, a YAML or JSON file that can be local, s3 or - for stdin. Flags override
+the file. Run 'http-science <command> -h' for the flags of a command.
+`
+
+// runJob runs a correctness, load or record job, see run. Tests replace it so no job is started
+var runJob = run
+
+// runCLI runs the subcommand in args and returns the code to exit with
+func runCLI(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return config.ExitError
+	}
+	cmd, args := args[0], args[1:]
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	loadPayload := payloadFlags(fs)
+
+	switch cmd {
+	case "correctness", "load", "record":
+		payload, err := parsePayload(fs, args, loadPayload)
+		if err != nil {
+			return printErr(err)
+		}
+		payload.JobType = cmd
+		runJob(payload)
+	case "validate-payload":
+		payload, err := parsePayload(fs, args, loadPayload)
+		if err != nil {
+			return printErr(err)
+		}
+		if payload, err = validate.Payload(payload); err != nil {
+			return printErr(err)
+		}
+		return printJSON(payload)
+	case "list-files":
+		payload, err := parsePayload(fs, args, loadPayload)
+		if err != nil {
+			return printErr(err)
+		}
+		if payload, err = validate.Files(payload); err != nil {
+			return printErr(err)
+		}
+		err = getfiles.Walk(payload, func(file string) error {
+			fmt.Println(file)
+			return nil
+		})
+		if err != nil {
+			return printErr(err)
+		}
+	case "compare-dumps":
+		return compareDumps(fs, args, loadPayload)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", cmd, usage)
+		return config.ExitError
+	}
+	return config.ExitPass
+}
+
+// compareDumps prints the fields that differ between two raw HTTP responses. It exits
+// with ExitThresholdsFailed if there are any, like a correctness test with max_diff_rate 0
+func compareDumps(fs *flag.FlagSet, args []string, loadPayload func() (*config.Payload, error)) int {
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: http-science compare-dumps [flags] <control file> <experiment file>\n")
+		fs.PrintDefaults()
+	}
+	payload, err := parsePayload(fs, args, loadPayload)
+	if err != nil {
+		return printErr(err)
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return config.ExitError
+	}
+	comparator := science.Comparator{
+		WeakCompare:      payload.WeakCompare,
+		IgnoredHeaders:   payload.IgnoredHeaders,
+		IgnoredBodyPaths: payload.IgnoredBodyPaths,
+	}
+
+	control, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return printErr(err)
+	}
+	experiment, err := ioutil.ReadFile(fs.Arg(1))
+	if err != nil {
+		return printErr(err)
+	}
+	fields, err := comparator.DiffResponses(control, experiment)
+	if err != nil {
+		return printErr(err)
+	}
+	for _, field := range fields {
+		fmt.Println(field)
+	}
+	if len(fields) > 0 {
+		return config.ExitThresholdsFailed
+	}
+	return config.ExitPass
+}
+
+func parsePayload(fs *flag.FlagSet, args []string, loadPayload func() (*config.Payload, error)) (*config.Payload, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return loadPayload()
+}
+
+func printErr(err error) int {
+	if err != flag.ErrHelp {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	}
+	return config.ExitError
+}
+
+func printJSON(v interface{}) int {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return printErr(err)
+	}
+	fmt.Println(string(buf))
+	return config.ExitPass
+}
+
+// payloadFlags registers -payload-file and a flag for each payload field with a json tag, named
+// after the tag with dashes. The returned func loads the payload file then applies the flags that were set
+func payloadFlags(fs *flag.FlagSet) func() (*config.Payload, error) {
+	payloadFile := fs.String("payload-file", "", "load the payload from this YAML or JSON file, - for stdin")
+	flagPayload := reflect.ValueOf(&config.Payload{}).Elem()
+	fields := map[string]int{}
+	for i := 0; i < flagPayload.NumField(); i++ {
+		tag := strings.Split(flagPayload.Type().Field(i).Tag.Get("json"), ",")[0]
+		field := flagPayload.Field(i)
+		if tag == "" || tag == "-" || !isFlagKind(field) {
+			continue
+		}
+		name := strings.Replace(tag, "_", "-", -1)
+		fs.Var(fieldValue{field}, name, fmt.Sprintf("payload %s", tag))
+		fields[name] = i
+	}
+
+	return func() (*config.Payload, error) {
+		payload := &config.Payload{}
+		if *payloadFile != "" {
+			buf, err := readPayloadFile(*payloadFile)
+			if err != nil {
+				return nil, err
+			}
+			if payload, err = config.ParseFile(buf); err != nil {
+				return nil, fmt.Errorf("error parsing %s:\n%s", *payloadFile, err)
+			}
+		}
+		fs.Visit(func(f *flag.Flag) {
+			if i, ok := fields[f.Name]; ok {
+				reflect.ValueOf(payload).Elem().Field(i).Set(flagPayload.Field(i))
+			}
+		})
+		return payload, nil
+	}
+}
+
+func readPayloadFile(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	reader, err := pathio.Reader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func isFlagKind(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Int, reflect.Int64, reflect.Bool, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return v.Type().Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// fieldValue is a flag.Value that sets a field of a payload
+type fieldValue struct {
+	v reflect.Value
+}
+
+func (f fieldValue) String() string {
+	if !f.v.IsValid() {
+		return ""
+	}
+	if f.v.Kind() == reflect.Slice {
+		return strings.Join(f.v.Convert(reflect.TypeOf([]string{})).Interface().([]string), ",")
+	}
+	return fmt.Sprint(f.v.Interface())
+}
+
+func (f fieldValue) IsBoolFlag() bool {
+	return f.v.IsValid() && f.v.Kind() == reflect.Bool
+}
+
+func (f fieldValue) Set(s string) error {
+	switch f.v.Kind() {
+	case reflect.String:
+		f.v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetBool(b)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.v.SetFloat(n)
+	case reflect.Slice:
+		f.v.Set(reflect.ValueOf(strings.Split(s, ",")).Convert(f.v.Type()))
+	}
+	return nil
+}
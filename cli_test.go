@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+)
+
+func TestPayloadFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cli")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "payload.json")
+	assert.Nil(t, ioutil.WriteFile(file, []byte(`{"service_name": "from-file", "reqs": 10, "control_env": "prod"}`), 0644))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	loadPayload := payloadFlags(fs)
+	payload, err := parsePayload(fs, []string{
+		"-payload-file", file, "-service-name", "from-flag", "-weak-equal", "-ignored-headers", "A,B", "-diff-chunk-bytes", "100",
+	}, loadPayload)
+	assert.Nil(t, err)
+
+	// Flags override the file, fields that aren't flags come from the file
+	assert.Equal(t, "from-flag", payload.ServiceName)
+	assert.Equal(t, 10, payload.Reqs)
+	assert.Equal(t, "prod", payload.ControlEnv)
+	assert.True(t, payload.WeakCompare)
+	assert.Equal(t, []string{"A", "B"}, payload.IgnoredHeaders)
+	assert.Equal(t, int64(100), payload.DiffChunkBytes)
+}
+
+func TestRunCLI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cli")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		assert.Nil(t, ioutil.WriteFile(file, []byte(content), 0644))
+		return file
+	}
+	ok := write("ok", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	notFound := write("not-found", "HTTP/1.1 404 Not Found\r\nContent-Length: 2\r\n\r\nno")
+	har := write("requests.har", `{"log": {"entries": []}}`)
+
+	var ran *config.Payload
+	defer func(run func(*config.Payload)) { runJob = run }(runJob)
+	runJob = func(payload *config.Payload) { ran = payload }
+
+	for _, test := range []struct {
+		args []string
+		code int
+		// job is the job type runJob is called with, if it is
+		job string
+	}{
+		{[]string{"correctness", "-service-name", "svc"}, config.ExitPass, "correctness"},
+		{[]string{"load", "-service-name", "svc"}, config.ExitPass, "load"},
+		{[]string{"record", "-service-name", "svc"}, config.ExitPass, "record"},
+		{[]string{"validate-payload", "-service-name", "svc", "-job-type", "load", "-load-url", "http://localhost:8000"}, config.ExitPass, ""},
+		{[]string{"validate-payload", "-job-type", "load"}, config.ExitError, ""},
+		{[]string{"list-files", "-service-name", "svc", "-har-file", har}, config.ExitPass, ""},
+		{[]string{"list-files"}, config.ExitError, ""},
+		{[]string{"compare-dumps", ok, ok}, config.ExitPass, ""},
+		{[]string{"compare-dumps", ok, notFound}, config.ExitThresholdsFailed, ""},
+		{[]string{"compare-dumps", ok}, config.ExitError, ""},
+		{[]string{"help"}, config.ExitPass, ""},
+		{[]string{"unknown"}, config.ExitError, ""},
+		{[]string{}, config.ExitError, ""},
+
+		// Invalid flag values fail before running anything
+		{[]string{"correctness", "-service-name", "svc", "-reqs", "many"}, config.ExitError, ""},
+		{[]string{"load", "-service-name", "svc", "-speed", "1.5"}, config.ExitError, ""},
+		{[]string{"record", "-service-name", "svc", "-weak-equal=maybe"}, config.ExitError, ""},
+		{[]string{"correctness", "-no-such-flag"}, config.ExitError, ""},
+		{[]string{"correctness", "-payload-file", filepath.Join(dir, "missing.json")}, config.ExitError, ""},
+		{[]string{"validate-payload", "-reqs", "many"}, config.ExitError, ""},
+		{[]string{"compare-dumps", "-weak-equal=maybe", ok, ok}, config.ExitError, ""},
+	} {
+		ran = nil
+		assert.Equal(t, test.code, runCLI(test.args), "%v", test.args)
+		if test.job == "" {
+			assert.Nil(t, ran, "%v", test.args)
+			continue
+		}
+		if assert.NotNil(t, ran, "%v", test.args) {
+			assert.Equal(t, test.job, ran.JobType, "%v", test.args)
+			assert.Equal(t, "svc", ran.ServiceName, "%v", test.args)
+		}
+	}
+}
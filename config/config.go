@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strings"
 	"sync"
 
 	"gopkg.in/Clever/kayvee-go.v3/logger"
@@ -16,6 +17,15 @@ var WeakCompare = false
 // IgnoredHeaders are the headers we ignore diffs on
 var IgnoredHeaders []string
 
+// IgnoredBodyPaths are the JSON body paths we ignore diffs on, e.g. "users[].updated_at"
+var IgnoredBodyPaths []string
+
+// RouteRules are comparison rules for specific routes
+var RouteRules []RouteRule
+
+// DiffSampleSize is the max number of diffs logged per route and status code pair. Ignored if value <= 0
+var DiffSampleSize = 0
+
 // Concurrency is the max number of concurrent requests and a mutex. Ignored if value < 0
 var Concurrency = struct {
 	Value int
@@ -25,44 +35,275 @@ var Concurrency = struct {
 	Mutex: &sync.Mutex{},
 }
 
+// SafeMethods are the methods that don't change anything. Replaying any other method needs allow_writes
+var SafeMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE"}
+
+// IsSafeMethod returns true if the method is one of SafeMethods
+func IsSafeMethod(method string) bool {
+	for _, m := range SafeMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteRule is a comparison rule for a normalized route, e.g. "GET /v1/users/:id", or "/v1/users/:id" for any method
+type RouteRule struct {
+	Route            string   `json:"route"`
+	IgnoredHeaders   []string `json:"ignored_headers"`
+	IgnoredBodyPaths []string `json:"ignored_body_paths"`
+}
+
+// Matches returns true if the rule applies to the route, which includes the method
+func (r RouteRule) Matches(route string) bool {
+	if r.Route == route {
+		return true
+	}
+	parts := strings.SplitN(route, " ", 2)
+	return len(parts) == 2 && r.Route == parts[1]
+}
+
+// Rewrite is how requests are changed before they are forwarded to a target. Headers are removed,
+// set then replaced, followed by the host, path, query and body changes
+type Rewrite struct {
+	RemoveHeaders  []string          `json:"remove_headers"`
+	SetHeaders     map[string]string `json:"set_headers"`
+	ReplaceHeaders []Replace         `json:"replace_headers"`
+	// Host overrides the Host header
+	Host  string    `json:"host"`
+	Path  []Replace `json:"path"`
+	Query []Replace `json:"query"`
+	// Body sets fields of JSON bodies, keyed by path like ignored_body_paths, e.g. "items[].cursor"
+	Body map[string]interface{} `json:"body"`
+}
+
+// Replace replaces the matches of a regex, e.g. in the path or the values of a header.
+// Replacement can refer to groups as $1
+type Replace struct {
+	// Header is the header to replace in, only for replace_headers
+	Header      string `json:"header"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// IsEmpty returns true if the rewrite doesn't change anything
+func (r Rewrite) IsEmpty() bool {
+	return len(r.RemoveHeaders) == 0 && len(r.SetHeaders) == 0 && len(r.ReplaceHeaders) == 0 &&
+		r.Host == "" && len(r.Path) == 0 && len(r.Query) == 0 && len(r.Body) == 0
+}
+
+// Auth is where the credentials added to requests to a target come from. Exactly one of Env, File
+// and Command is set
+type Auth struct {
+	// Header is the header the credentials are set in, default Authorization
+	Header string `json:"header"`
+	// Prefix is put before the token, e.g. "Bearer "
+	Prefix string `json:"prefix"`
+	// Env is an environment variable holding the token
+	Env string `json:"env"`
+	// File is a file holding the token
+	File string `json:"file"`
+	// Command is run with sh -c and prints the token
+	Command string `json:"command"`
+	// RefreshInterval is how often in seconds File is re-read or Command re-run, default 300
+	RefreshInterval int `json:"refresh_interval"`
+}
+
+// IsEmpty returns true if no credentials are configured
+func (a Auth) IsEmpty() bool {
+	return a.Env == "" && a.File == "" && a.Command == ""
+}
+
+// Redact is what is replaced with hashes in diffs before they are written, on top of the credential
+// headers that are always redacted
+type Redact struct {
+	Headers []string `json:"headers"`
+	// BodyPaths are JSON body paths like ignored_body_paths, e.g. "users[].email"
+	BodyPaths []string `json:"body_paths"`
+	// Patterns are regexes whose matches anywhere in a request or response are redacted
+	Patterns []string `json:"patterns"`
+	// HashKeyEnv is an environment variable holding the key values are hashed with. Without it a
+	// random key is used, so hashes are only the same within a run
+	HashKeyEnv string `json:"hash_key_env"`
+}
+
+// Stub is a canned response the stub server returns to matching requests. Empty fields match anything
+type Stub struct {
+	Method string `json:"method"`
+	// Host matches the Host header
+	Host string `json:"host"`
+	// URLRegex matches the path and query, BodyRegex the request body
+	URLRegex  string `json:"url_regex"`
+	BodyRegex string `json:"body_regex"`
+	// Status is the response status, default 200
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// Filter picks which requests are replayed, on top of methods, allow_url_regex and disallow_url_regex
+type Filter struct {
+	// Headers are regexes the named headers must match. Requests whose headers match ExcludeHeaders
+	// aren't replayed. An empty regex matches any value, so it only checks the header is there
+	Headers        map[string]string `json:"headers"`
+	ExcludeHeaders map[string]string `json:"exclude_headers"`
+	// QueryParams must all be in the query
+	QueryParams    []string `json:"query_params"`
+	BodyRegex      string   `json:"body_regex"`
+	UserAgentRegex string   `json:"user_agent_regex"`
+	// SamplePercent is the percentage of requests replayed, picked by a hash of the request so
+	// the same ones are picked every run. Default 100
+	SamplePercent float64 `json:"sample_percent"`
+	// MaxRouteRate is the max requests per second replayed to each normalized route. Ignored if <= 0
+	MaxRouteRate float64 `json:"max_route_rate"`
+}
+
+// Selection picks requests for route coverage instead of replaying the busiest routes the most
+type Selection struct {
+	// Dedup only replays the first of identical requests, by method, URL and body
+	Dedup bool `json:"dedup"`
+	// PerRoute is the max requests replayed to each normalized route. Ignored if value <= 0
+	PerRoute int `json:"per_route"`
+}
+
+// Thresholds are the success criteria for a job. Unset thresholds aren't checked
+type Thresholds struct {
+	// MaxDiffRate is the max fraction of requests with diffs, e.g. 0.01
+	MaxDiffRate *float64 `json:"max_diff_rate"`
+	// MaxDiffsPerRoute is the max number of diffs on any normalized route
+	MaxDiffsPerRoute *int `json:"max_diffs_per_route"`
+	// MaxErrorRate is the max fraction of requests that failed or got a 5xx from the experiment (or load target)
+	MaxErrorRate *float64 `json:"max_error_rate"`
+	// MaxP99LatencyRegression is how much slower the experiment's p99 latency can be than the control's, e.g. 0.2 for 20%
+	MaxP99LatencyRegression *float64 `json:"max_p99_latency_regression"`
+	// MaxAuthFailureRate is the max fraction of responses from the control or experiment that are 401 or 403.
+	// It defaults to 0.5 so runs that mostly compare auth failures don't pass
+	MaxAuthFailureRate *float64 `json:"max_auth_failure_rate"`
+}
+
 // Payload is the payload specifiying info for a load test
 type Payload struct {
 	// Required
 	JobType     string `json:"job_type"`
 	ServiceName string `json:"service_name"`
 	// Only Correctness
-	ExperimentEnv  string   `json:"experiment_env"`
-	ControlEnv     string   `json:"control_env"`
-	ExperimentURL  string   // initialized in validate.go
-	ControlURL     string   // initialized in validate.go
+	ExperimentEnv string `json:"experiment_env"`
+	ControlEnv    string `json:"control_env"`
+	Control2Env   string `json:"control2_env"`
+	// The URLs are built from url_template and the envs in validate.go unless given explicitly
+	ExperimentURL  string   `json:"experiment_url"`
+	ControlURL     string   `json:"control_url"`
+	Control2URL    string   `json:"control2_url"`
 	DiffLoc        string   `json:"diff_loc"`
 	WeakCompare    bool     `json:"weak_equal"`
 	IgnoredHeaders []string `json:"ignored_headers"`
+	// IgnoredBodyPaths are JSON paths in the body to ignore, array elements are written as []
+	IgnoredBodyPaths []string `json:"ignored_body_paths"`
+	// Routes are comparison rules that only apply to some routes
+	Routes         []RouteRule `json:"routes"`
+	DiffSampleSize int         `json:"diff_sample_size"`
+	// The diff log is uploaded in chunks every DiffUploadInterval seconds or once it reaches DiffChunkBytes
+	DiffUploadInterval int   `json:"diff_upload_interval"`
+	DiffChunkBytes     int64 `json:"diff_chunk_bytes"`
 	// Only Load
 	LoadEnv string `json:"load_env"`
-	LoadURL string // initialized in validate.go
+	LoadURL string `json:"load_url"` // built from url_template and load_env in validate.go unless given
 	Speed   int    `json:"speed"`
+	// Only Record
+	RecordURL string `json:"record_url"`
+	// RecordSampleRate is the fraction of requests that are recorded, default 1
+	RecordSampleRate float64 `json:"record_sample_rate"`
+	// ListenAddr is where the record proxy listens, default :8080
+	ListenAddr string `json:"listen_addr"`
 	// Optional
-	Concurrency      int    `json:"concurrency"`
-	Reqs             int    `json:"reqs"`
-	JobNumber        int    `json:"job_number"`
-	TotalJobs        int    `json:"total_jobs"`
-	StartBefore      string `json:"start_before"`
-	Methods          string `json:"methods"`
-	Email            string `json:"email"`
-	DisallowURLRegex string `json:"disallow_url_regex"`
-	AllowURLRegex    string `json:"allow_url_regex"`
-	Port             string `json:"port"`
-	PodID            string `json:"pod_id"`
-}
-
-// LogAndExitIfErr KV logs and exits with code 1 if there is an error
+	// CaptureLoc is where capture files are replayed from, or written to when recording, laid out
+	// as yyyy/mm/dd/hh/<file>. Defaults to s3://firehose-prod/replay-testing/<service_name>/
+	CaptureLoc string `json:"capture_loc"`
+	// HARFile is a HAR whose entries are replayed instead of the capture files, can be s3 or a local path
+	HARFile          string     `json:"har_file"`
+	Concurrency      int        `json:"concurrency"`
+	Reqs             int        `json:"reqs"`
+	JobNumber        int        `json:"job_number"`
+	TotalJobs        int        `json:"total_jobs"`
+	StartBefore      string     `json:"start_before"`
+	Methods          StringList `json:"methods"`
+	Email            string     `json:"email"`
+	DisallowURLRegex StringList `json:"disallow_url_regex"`
+	AllowURLRegex    StringList `json:"allow_url_regex"`
+	Port             string     `json:"port"`
+	PodID            string     `json:"pod_id"`
+	// AllowWrites acknowledges that methods other than SafeMethods are replayed
+	AllowWrites bool `json:"allow_writes"`
+	// ProductionPattern is a regex matching the hosts of production targets, which writes are never sent to
+	ProductionPattern string `json:"production_pattern"`
+	// DryRun sends writes only to DryRunURL, or the experiment if it isn't set, without comparing them
+	DryRun    bool   `json:"dry_run"`
+	DryRunURL string `json:"dry_run_url"`
+	// Filter picks which of the requests gor replays are forwarded
+	Filter Filter `json:"filter"`
+	// Selection is applied after Filter
+	Selection Selection `json:"selection"`
+	// StubAddr is where the stub server listens for the requests targets make to their downstream services.
+	// It serves Stubs, then the recorded responses in StubFiles, which are capture files or HARs
+	StubAddr  string     `json:"stub_addr"`
+	Stubs     []Stub     `json:"stubs"`
+	StubFiles StringList `json:"stub_files"`
+	// Rewrite applies to the requests to every target, then RewriteControl to the controls
+	// and RewriteExperiment to the experiment
+	Rewrite           Rewrite `json:"rewrite"`
+	RewriteControl    Rewrite `json:"rewrite_control"`
+	RewriteExperiment Rewrite `json:"rewrite_experiment"`
+	// Auth adds credentials to the requests to every target unless AuthControl or AuthExperiment
+	// is set for it. They are added after rewriting
+	Auth           Auth `json:"auth"`
+	AuthControl    Auth `json:"auth_control"`
+	AuthExperiment Auth `json:"auth_experiment"`
+	// Redact is the sensitive data removed from diffs before they are written to the diff log, report or HAR
+	Redact Redact `json:"redact"`
+	// URLTemplate builds target URLs from envs. {env}, {service}, {port} and {pod} (--<pod_id> if set) are replaced
+	URLTemplate string `json:"url_template"`
+	// SummaryLoc is where the JSON summary of the run is written. Defaults to next to diff_loc
+	SummaryLoc string `json:"summary_loc"`
+	// ReportLoc is where the HTML report of a correctness run is written. Defaults to next to diff_loc
+	ReportLoc string `json:"report_loc"`
+	// HARLoc is where a HAR of the sampled diffs of a correctness run is written. Defaults to next to diff_loc
+	HARLoc string `json:"har_loc"`
+	// Progress is checkpointed to CheckpointLoc every CheckpointInterval seconds. If Resume is set
+	// the job continues from the checkpoint at CheckpointLoc
+	CheckpointLoc      string     `json:"checkpoint_loc"`
+	CheckpointInterval int        `json:"checkpoint_interval"`
+	Resume             bool       `json:"resume"`
+	Thresholds         Thresholds `json:"thresholds"`
+	// Secrets are the environment variable values ParseFile interpolated, which are redacted from summaries
+	Secrets []string `json:"-"`
+}
+
+// Exit codes
+const (
+	// ExitPass is the exit code when the job finished and met every threshold
+	ExitPass = 0
+	// ExitError is the exit code when the job failed, see LogAndExitIfErr
+	ExitError = 1
+	// ExitThresholdsFailed is the exit code when the job finished but didn't meet a threshold
+	ExitThresholdsFailed = 2
+	// ExitInterrupted is the exit code when the job is stopped by SIGTERM or SIGINT before finishing
+	ExitInterrupted = 3
+	// ExitOutOfFiles is the exit code when the job ran out of files before replaying the requests asked for
+	ExitOutOfFiles = 4
+)
+
+// LogAndExitIfErr KV logs and exits with ExitError if there is an error
 func LogAndExitIfErr(err error, title string, extra interface{}) {
 	if err != nil {
+		// The payload can hold credentials
+		if payload, ok := extra.(*Payload); ok {
+			extra = payload.Redacted()
+		}
 		KV.ErrorD(title, logger.M{
 			"payload": extra,
 			"error":   err.Error(),
 		})
-		os.Exit(1)
+		os.Exit(ExitError)
 	}
 }
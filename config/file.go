@@ -0,0 +1,209 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envVar matches ${VAR} in a config file. $VAR isn't interpolated so regexes can use $
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ParseFile parses a payload from a YAML or JSON config file. ${VAR} in a string value is replaced with
+// the environment variable VAR, and every unknown field, wrongly typed field and missing variable is
+// reported at once
+func ParseFile(buf []byte) (*Payload, error) {
+	var raw interface{}
+	if strings.HasPrefix(strings.TrimSpace(string(buf)), "{") {
+		// YAML is a superset of JSON, but not JSON indented with tabs
+		decoder := json.NewDecoder(bytes.NewReader(buf))
+		decoder.UseNumber()
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+	} else if err := yaml.Unmarshal(buf, &raw); err != nil {
+		return nil, err
+	}
+	raw = jsonCompatible(raw)
+	// Variables are interpolated after parsing so their values can't change the structure of the config
+	errs := []error{}
+	secrets := []string{}
+	raw = interpolate(raw, &secrets, &errs)
+	errs = append(errs, checkSchema(raw, reflect.TypeOf(Payload{}), "")...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	buf, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	payload := &Payload{}
+	if err := json.Unmarshal(buf, payload); err != nil {
+		return nil, err
+	}
+	payload.Secrets = secrets
+	return payload, nil
+}
+
+// jsonCompatible converts the map[interface{}]interface{}s yaml decodes to map[string]interface{}
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, val := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonCompatible(v[i])
+		}
+	}
+	return v
+}
+
+// interpolate replaces ${VAR} in the string values in v, adding the values to secrets and an error to errs
+// for every variable that isn't set
+func interpolate(v interface{}, secrets *[]string, errs *[]error) interface{} {
+	switch v := v.(type) {
+	case string:
+		return envVar.ReplaceAllStringFunc(v, func(match string) string {
+			name := envVar.FindStringSubmatch(match)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				*errs = append(*errs, fmt.Errorf("environment variable %s is not set", name))
+			} else if value != "" {
+				*secrets = append(*secrets, value)
+			}
+			return value
+		})
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			v[k] = interpolate(v[k], secrets, errs)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = interpolate(v[i], secrets, errs)
+		}
+	}
+	return v
+}
+
+// checkSchema returns an error for every value in v that doesn't fit the type t. path is where v is in the file
+func checkSchema(v interface{}, t reflect.Type, path string) []error {
+	if v == nil {
+		return nil
+	}
+	wrongType := func(expected string) []error {
+		return []error{fmt.Errorf("%s must be %s, got %v", name(path), expected, v)}
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(StringList{}) {
+		if _, ok := v.(string); ok {
+			return nil
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return wrongType("an object")
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if tag != "" && tag != "-" {
+				fields[tag] = t.Field(i).Type
+			}
+		}
+		errs := []error{}
+		for _, k := range sortedKeys(m) {
+			fieldType, ok := fields[k]
+			if !ok {
+				errs = append(errs, fmt.Errorf("unknown field %s", name(join(path, k))))
+				continue
+			}
+			errs = append(errs, checkSchema(m[k], fieldType, join(path, k))...)
+		}
+		return errs
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return wrongType("an object")
+		}
+		errs := []error{}
+		for _, k := range sortedKeys(m) {
+			errs = append(errs, checkSchema(m[k], t.Elem(), join(path, k))...)
+		}
+		return errs
+	case reflect.Slice:
+		list, ok := v.([]interface{})
+		if !ok {
+			return wrongType("a list")
+		}
+		errs := []error{}
+		for i, elem := range list {
+			errs = append(errs, checkSchema(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return errs
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			return wrongType("a string")
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			return wrongType("true or false")
+		}
+	case reflect.Int, reflect.Int64:
+		if n, ok := v.(json.Number); ok {
+			if _, err := n.Int64(); err == nil {
+				return nil
+			}
+		}
+		if _, ok := v.(int); !ok {
+			return wrongType("an integer")
+		}
+	case reflect.Float64:
+		switch v.(type) {
+		case int, float64, json.Number:
+		default:
+			return wrongType("a number")
+		}
+	}
+	return nil
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func name(path string) string {
+	if path == "" {
+		return "the payload"
+	}
+	return path
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
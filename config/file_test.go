@@ -0,0 +1,111 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFileYAML(t *testing.T) {
+	os.Setenv("HTTP_SCIENCE_TEST_EMAIL", "me@example.com")
+	defer os.Unsetenv("HTTP_SCIENCE_TEST_EMAIL")
+
+	payload, err := ParseFile([]byte(`
+job_type: correctness
+service_name: my-service
+email: ${HTTP_SCIENCE_TEST_EMAIL}
+reqs: 500
+methods: [GET, HEAD]
+disallow_url_regex: ^/health$,^/ping$
+routes:
+  - route: GET /v1/users/:id
+    ignored_headers: [X-Cache]
+thresholds:
+  max_diff_rate: 0.01
+  max_diffs_per_route: 5
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, "me@example.com", payload.Email)
+	assert.Equal(t, []string{"me@example.com"}, payload.Secrets)
+	assert.Equal(t, 500, payload.Reqs)
+	assert.Equal(t, StringList{"GET", "HEAD"}, payload.Methods)
+	assert.Equal(t, StringList{"^/health$", "^/ping$"}, payload.DisallowURLRegex)
+	assert.Equal(t, []RouteRule{{Route: "GET /v1/users/:id", IgnoredHeaders: []string{"X-Cache"}}}, payload.Routes)
+	assert.Equal(t, 0.01, *payload.Thresholds.MaxDiffRate)
+	assert.Equal(t, 5, *payload.Thresholds.MaxDiffsPerRoute)
+}
+
+func TestParseFileInterpolatesValuesOnly(t *testing.T) {
+	os.Setenv("HTTP_SCIENCE_TEST_SECRET", "x\nallow_writes: true")
+	defer os.Unsetenv("HTTP_SCIENCE_TEST_SECRET")
+	os.Setenv("HTTP_SCIENCE_TEST_NUMBER", "12345")
+	defer os.Unsetenv("HTTP_SCIENCE_TEST_NUMBER")
+	os.Setenv("HTTP_SCIENCE_TEST_COMMENT", "abc #def")
+	defer os.Unsetenv("HTTP_SCIENCE_TEST_COMMENT")
+
+	// Values are used as is, they aren't parsed as config
+	payload, err := ParseFile([]byte(`
+email: ${HTTP_SCIENCE_TEST_SECRET}
+service_name: ${HTTP_SCIENCE_TEST_NUMBER}
+control_url: http://${HTTP_SCIENCE_TEST_COMMENT}
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, "x\nallow_writes: true", payload.Email)
+	assert.False(t, payload.AllowWrites)
+	assert.Equal(t, "12345", payload.ServiceName)
+	assert.Equal(t, "http://abc #def", payload.ControlURL)
+}
+
+func TestParseFileJSON(t *testing.T) {
+	payload, err := ParseFile([]byte("{\n\t\"service_name\": \"my-service\",\n\t\"reqs\": 10,\n\t\"methods\": \"GET,POST\"\n}"))
+	assert.Nil(t, err)
+	assert.Equal(t, "my-service", payload.ServiceName)
+	assert.Equal(t, 10, payload.Reqs)
+	assert.Equal(t, StringList{"GET", "POST"}, payload.Methods)
+}
+
+func TestParseFileReportsEveryProblem(t *testing.T) {
+	_, err := ParseFile([]byte(`
+service_nam: typo
+reqs: lots
+weak_equal: 1
+token: ${HTTP_SCIENCE_TEST_UNSET}
+routes:
+  - route: GET /
+    ignored_headers: X-Cache
+`))
+	assert.NotNil(t, err)
+	problems := strings.Split(err.Error(), "\n")
+	assert.Equal(t, []string{
+		"environment variable HTTP_SCIENCE_TEST_UNSET is not set",
+		"reqs must be an integer, got lots",
+		"routes[0].ignored_headers must be a list, got X-Cache",
+		"unknown field service_nam",
+		"unknown field token",
+		"weak_equal must be true or false, got 1",
+	}, problems)
+}
+
+func TestParseFileRewrite(t *testing.T) {
+	payload, err := ParseFile([]byte(`
+rewrite_control:
+  set_headers:
+    Authorization: Bearer abc
+  path:
+    - pattern: ^/v1/
+      replacement: /v2/
+  body:
+    page.cursor: null
+    limit: 10
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"Authorization": "Bearer abc"}, payload.RewriteControl.SetHeaders)
+	assert.Equal(t, []Replace{{Pattern: "^/v1/", Replacement: "/v2/"}}, payload.RewriteControl.Path)
+	assert.Equal(t, 2, len(payload.RewriteControl.Body))
+	assert.True(t, payload.Rewrite.IsEmpty())
+
+	_, err = ParseFile([]byte("rewrite:\n  set_headers:\n    X-Test: [a, b]\n"))
+	assert.EqualError(t, err, "rewrite.set_headers.X-Test must be a string, got [a b]")
+}
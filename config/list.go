@@ -0,0 +1,32 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// StringList is a list of strings that can be given in a payload as a list or as a comma separated string
+type StringList []string
+
+// UnmarshalJSON accepts either ["a", "b"] or "a,b"
+func (l *StringList) UnmarshalJSON(buf []byte) error {
+	var list []string
+	if err := json.Unmarshal(buf, &list); err == nil {
+		*l = list
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+	*l = ParseStringList(s)
+	return nil
+}
+
+// ParseStringList splits a comma separated string, an empty string is an empty list
+func ParseStringList(s string) StringList {
+	if s == "" {
+		return StringList{}
+	}
+	return StringList(strings.Split(s, ","))
+}
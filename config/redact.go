@@ -0,0 +1,85 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// RedactedValue replaces secrets in the payload when it is logged or written with the summary
+const RedactedValue = "[redacted]"
+
+// Redacted returns a copy of the payload without the secrets it may hold: header values set by
+// rewrites, where credentials come from, what is redacted from diffs and the values interpolated from
+// environment variables
+func (payload *Payload) Redacted() *Payload {
+	if payload == nil {
+		return nil
+	}
+	p := *payload
+	p.Rewrite = redactRewrite(p.Rewrite)
+	p.RewriteControl = redactRewrite(p.RewriteControl)
+	p.RewriteExperiment = redactRewrite(p.RewriteExperiment)
+	p.Auth, p.AuthControl, p.AuthExperiment = Auth{}, Auth{}, Auth{}
+	p.Redact = Redact{}
+	p.Secrets = nil
+	if len(payload.Secrets) == 0 {
+		return &p
+	}
+
+	// Secrets can be anywhere in a string value, so replace them in every string of the JSON
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return &p
+	}
+	var raw interface{}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return &p
+	}
+	if buf, err = json.Marshal(redactStrings(raw, payload.Secrets)); err != nil {
+		return &p
+	}
+	redacted := &Payload{}
+	if err := json.Unmarshal(buf, redacted); err != nil {
+		return &p
+	}
+	return redacted
+}
+
+func redactRewrite(r Rewrite) Rewrite {
+	if len(r.SetHeaders) > 0 {
+		headers := map[string]string{}
+		for h := range r.SetHeaders {
+			headers[h] = RedactedValue
+		}
+		r.SetHeaders = headers
+	}
+	if len(r.ReplaceHeaders) > 0 {
+		replaces := make([]Replace, len(r.ReplaceHeaders))
+		for i, replace := range r.ReplaceHeaders {
+			replace.Replacement = RedactedValue
+			replaces[i] = replace
+		}
+		r.ReplaceHeaders = replaces
+	}
+	return r
+}
+
+// redactStrings replaces the secrets in every string in v, which is decoded JSON
+func redactStrings(v interface{}, secrets []string) interface{} {
+	switch v := v.(type) {
+	case string:
+		for _, s := range secrets {
+			v = strings.Replace(v, s, RedactedValue, -1)
+		}
+		return v
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = redactStrings(v[k], secrets)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactStrings(v[i], secrets)
+		}
+	}
+	return v
+}
@@ -0,0 +1,239 @@
+package difflog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+	"gopkg.in/Clever/pathio.v3"
+
+	"github.com/Clever/http-science/config"
+)
+
+// Manifest lists every chunk of a diff log along with the summary of the run
+type Manifest struct {
+	Chunks  []string    `json:"chunks"`
+	Summary interface{} `json:"summary"`
+}
+
+// Writer writes a diff log to local chunk files. Each chunk is uploaded to <loc>.<chunk number>
+// and deleted locally once it is rotated, so diffs survive the worker being killed mid-run.
+// Uploads happen outside the lock writes take, so a slow upload doesn't hold up writing diffs
+type Writer struct {
+	loc      string
+	maxBytes int64
+	mutex    *sync.Mutex
+	file     *os.File
+	size     int64
+	// chunks are the uploaded chunks, pending the rotated ones waiting to be uploaded, and next the
+	// number of the last chunk rotated
+	chunks  []string
+	pending []chunk
+	next    int
+	// uploading is held while uploading so chunks are uploaded one at a time in order
+	uploading *sync.Mutex
+	done      chan struct{}
+}
+
+// chunk is a rotated chunk's local file and where it is uploaded to
+type chunk struct {
+	file string
+	loc  string
+}
+
+// New returns a Writer that uploads chunks next to loc and rotates once a chunk reaches maxBytes
+func New(loc string, maxBytes int64) (*Writer, error) {
+	return Resume(loc, maxBytes, []string{})
+}
+
+// Resume returns a Writer that continues a diff log that already has chunks uploaded
+func Resume(loc string, maxBytes int64, chunks []string) (*Writer, error) {
+	w := &Writer{
+		loc:       loc,
+		maxBytes:  maxBytes,
+		mutex:     &sync.Mutex{},
+		chunks:    chunks,
+		next:      len(chunks),
+		uploading: &sync.Mutex{},
+		done:      make(chan struct{}),
+	}
+	return w, w.openChunk()
+}
+
+// Chunks returns the chunks that have been uploaded so far
+func (w *Writer) Chunks() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]string{}, w.chunks...)
+}
+
+// ManifestLoc returns where the manifest for the diff log at loc is written
+func ManifestLoc(loc string) string {
+	return loc + ".manifest.json"
+}
+
+func (w *Writer) openChunk() error {
+	f, err := ioutil.TempFile(os.TempDir(), "")
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.size = 0
+	return nil
+}
+
+// Write writes to the current chunk. Once it has grown past maxBytes it is rotated and uploaded in the background
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil {
+		// Opening the last chunk failed, try again
+		if err := w.openChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if w.maxBytes > 0 && w.size >= w.maxBytes {
+		err = w.rotate()
+		go func() {
+			if err := w.upload(); err != nil {
+				config.KV.ErrorD("uploading-diff-log-failed", logger.M{"error": err.Error()})
+			}
+		}()
+	}
+	return n, err
+}
+
+// Rotate starts a new chunk if the current one has anything in it, and uploads the rotated chunks
+func (w *Writer) Rotate() error {
+	w.mutex.Lock()
+	err := w.rotate()
+	w.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return w.upload()
+}
+
+// Snapshot starts a new chunk if the current one has anything in it, and returns every chunk so far
+// whether or not it has been uploaded yet. Call Upload before relying on them
+func (w *Writer) Snapshot() ([]string, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	chunks := append([]string{}, w.chunks...)
+	for _, c := range w.pending {
+		chunks = append(chunks, c.loc)
+	}
+	return chunks, nil
+}
+
+// Upload uploads the rotated chunks
+func (w *Writer) Upload() error {
+	return w.upload()
+}
+
+// rotate closes the current chunk, queues it to be uploaded and starts a new one. w.mutex must be held
+func (w *Writer) rotate() error {
+	if w.file == nil || w.size == 0 {
+		return nil
+	}
+	name := w.file.Name()
+	closeErr := w.file.Close()
+	w.file = nil
+	w.next++
+	w.pending = append(w.pending, chunk{file: name, loc: fmt.Sprintf("%s.%05d", w.loc, w.next)})
+	if err := w.openChunk(); err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// upload uploads the rotated chunks in order, removing each locally once it is uploaded. If one fails
+// it and the chunks after it are kept locally and retried on the next upload
+func (w *Writer) upload() error {
+	w.uploading.Lock()
+	defer w.uploading.Unlock()
+	for {
+		w.mutex.Lock()
+		if len(w.pending) == 0 {
+			w.mutex.Unlock()
+			return nil
+		}
+		c := w.pending[0]
+		w.mutex.Unlock()
+
+		if err := uploadFile(c); err != nil {
+			return fmt.Errorf("error uploading diff log chunk %s, it is kept at %s: %s", c.loc, c.file, err)
+		}
+		os.Remove(c.file)
+		w.mutex.Lock()
+		w.pending = w.pending[1:]
+		w.chunks = append(w.chunks, c.loc)
+		w.mutex.Unlock()
+	}
+}
+
+func uploadFile(c chunk) error {
+	f, err := os.Open(c.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pathio.WriteReader(c.loc, f)
+}
+
+// RotateEvery rotates the diff log on an interval until the Writer is closed
+func (w *Writer) RotateEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.Rotate(); err != nil {
+					config.KV.ErrorD("rotating-diff-log-failed", logger.M{"error": err.Error()})
+				}
+			case <-w.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close uploads the final chunk and writes the manifest with the summary of the run. If a chunk
+// can't be uploaded the error says where it is kept locally
+func (w *Writer) Close(summary interface{}) (*Manifest, error) {
+	w.mutex.Lock()
+	close(w.done)
+	err := w.rotate()
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+		w.file = nil
+	}
+	w.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.upload(); err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{Chunks: w.Chunks(), Summary: summary}
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return manifest, pathio.Write(ManifestLoc(w.loc), buf)
+}
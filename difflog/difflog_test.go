@@ -0,0 +1,100 @@
+package difflog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "difflog")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	loc := filepath.Join(dir, "diffs")
+
+	w, err := New(loc, 10)
+	assert.Nil(t, err)
+
+	// Rotates once a chunk reaches maxBytes
+	_, err = w.Write([]byte("0123456789"))
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("abc"))
+	assert.Nil(t, err)
+	// Rotating an empty chunk doesn't upload anything
+	assert.Nil(t, w.Rotate())
+	assert.Nil(t, w.Rotate())
+
+	manifest, err := w.Close(map[string]int{"diffs": 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{loc + ".00001", loc + ".00002"}, manifest.Chunks)
+
+	chunk, err := ioutil.ReadFile(loc + ".00001")
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789", string(chunk))
+	chunk, err = ioutil.ReadFile(loc + ".00002")
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", string(chunk))
+
+	buf, err := ioutil.ReadFile(ManifestLoc(loc))
+	assert.Nil(t, err)
+	var written struct {
+		Chunks  []string
+		Summary map[string]int
+	}
+	assert.Nil(t, json.Unmarshal(buf, &written))
+	assert.Equal(t, manifest.Chunks, written.Chunks)
+	assert.Equal(t, map[string]int{"diffs": 2}, written.Summary)
+}
+
+func TestWriterUploadFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "difflog")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	// A file where the diff log's directory should be makes uploads fail
+	blocker := filepath.Join(dir, "diffs")
+	assert.Nil(t, ioutil.WriteFile(blocker, []byte{}, 0644))
+	loc := filepath.Join(blocker, "log")
+
+	w, err := New(loc, 0)
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("first"))
+	assert.Nil(t, err)
+	err = w.Rotate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error uploading diff log chunk "+loc+".00001, it is kept at ")
+	assert.Equal(t, []string{}, w.Chunks())
+
+	// Diffs are still written to a new chunk, and the failed one is retried
+	_, err = w.Write([]byte("second"))
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(blocker))
+	manifest, err := w.Close(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{loc + ".00001", loc + ".00002"}, manifest.Chunks)
+	chunk, err := ioutil.ReadFile(loc + ".00001")
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(chunk))
+}
+
+func TestWriterSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "difflog")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	loc := filepath.Join(dir, "diffs")
+
+	w, err := New(loc, 0)
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("diff"))
+	assert.Nil(t, err)
+	// The chunks are named before they are uploaded
+	chunks, err := w.Snapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{loc + ".00001"}, chunks)
+	assert.Equal(t, []string{}, w.Chunks())
+	assert.Nil(t, w.Upload())
+	assert.Equal(t, chunks, w.Chunks())
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/difflog"
 	"github.com/Clever/http-science/science"
 	"github.com/keighl/mandrill"
 )
@@ -22,7 +23,7 @@ func SendEmail(payload *config.Payload, duration time.Duration, res science.Resu
 		"REQS":       strconv.Itoa(res.Reqs),
 		"NUM_DIFFS":  strconv.Itoa(res.Diffs),
 		"DIFFS_MAP":  fmt.Sprintf("%#v", res.Codes),
-		"DIFFS_FILE": payload.DiffLoc,
+		"DIFFS_FILE": difflog.ManifestLoc(payload.DiffLoc),
 		"TIME":       duration.String(),
 	})
 	science.Res.Mutex.Unlock()
@@ -14,16 +14,63 @@ import (
 	"gopkg.in/Clever/pathio.v3"
 
 	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/har"
 )
 
-// AddFilesToChan adds files from the specified location to a chan
-func AddFilesToChan(payload *config.Payload, files chan<- string) error {
-	base := "s3://firehose-prod/%s"
-	filePrefix := fmt.Sprintf("replay-testing/%s/", payload.ServiceName)
+// File is a capture file that has been downloaded to be replayed
+type File struct {
+	Remote string
+	Local  string
+}
+
+// AddFilesToChan adds files from the specified location to a chan, skipping any remote files in skip
+func AddFilesToChan(payload *config.Payload, files chan<- File, skip map[string]bool) error {
+	return Walk(payload, func(file string) error {
+		if skip[file] {
+			return nil
+		}
+		if file == payload.HARFile {
+			localfile, err := convertHAR(file)
+			if err != nil {
+				return fmt.Errorf("error converting HAR %s: %s", file, err)
+			}
+			files <- File{Remote: file, Local: localfile}
+			return nil
+		}
+		localfile, err := downloadFile(file)
+		if err != nil {
+			config.KV.ErrorD("s3-download-failed", logger.M{
+				"s3_filename": file,
+				"err":         err.Error(),
+				// for context:
+				"exp_url":     payload.ExperimentURL,
+				"control_url": payload.ControlURL,
+				"load_url":    payload.LoadURL,
+			})
+			return nil
+		}
+		files <- File{Remote: file, Local: localfile}
+		return nil
+	})
+}
+
+// Walk calls visit with each remote file under the payload's capture_loc that would be replayed, in order.
+// If the payload has a har_file it is the only file
+func Walk(payload *config.Payload, visit func(file string) error) error {
+	if payload.HARFile != "" {
+		return visit(payload.HARFile)
+	}
+	// pathio lists s3 keys without the bucket
+	bucketAndPrefix := strings.SplitN(strings.TrimPrefix(payload.CaptureLoc, "s3://"), "/", 2)
+	base := "s3://" + bucketAndPrefix[0] + "/%s"
+	filePrefix := ""
+	if len(bucketAndPrefix) > 1 {
+		filePrefix = bucketAndPrefix[1]
+	}
 	baseWithPrefix := fmt.Sprintf(base, filePrefix)
 
 	// Starting with the baseWithPrefix, build a stack of directories to explore and
-	// files to download.
+	// files to visit.
 	fileStack := []string{baseWithPrefix}
 	for len(fileStack) > 0 {
 		file := fileStack[len(fileStack)-1]
@@ -35,19 +82,9 @@ func AddFilesToChan(payload *config.Payload, files chan<- string) error {
 		}
 
 		if fileType == "file" {
-			localfile, err := downloadFile(file)
-			if err != nil {
-				config.KV.ErrorD("s3-download-failed", logger.M{
-					"s3_filename": file,
-					"err":         err.Error(),
-					// for context:
-					"exp_url":     payload.ExperimentURL,
-					"control_url": payload.ControlURL,
-					"load_url":    payload.LoadURL,
-				})
-				continue
+			if err := visit(file); err != nil {
+				return err
 			}
-			files <- localfile
 		} else {
 			newFiles, err := goDeeper(file, fileType, base, baseWithPrefix, payload)
 			if err != nil {
@@ -94,6 +131,31 @@ func downloadFile(file string) (string, error) {
 	return filename, nil
 }
 
+// convertHAR downloads a HAR and writes its requests to /tmp/filename.txt as a gor capture file
+func convertHAR(file string) (string, error) {
+	reader, err := pathio.Reader(file)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	h, err := har.Read(reader)
+	if err != nil {
+		return "", err
+	}
+	filename := fmt.Sprintf("%s/%s.txt", os.TempDir(), strings.Split(finalPath(file), ".")[0])
+	f, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	n, err := har.WriteGor(h, f)
+	if err != nil {
+		return "", err
+	}
+	config.KV.InfoD("converted-har", logger.M{"har_file": file, "reqs": n})
+	return filename, nil
+}
+
 // NextType maps a file type to the type that comes after it
 var NextType = map[string]string{
 	"base":  "year",
@@ -7,6 +7,7 @@ require (
 	github.com/stretchr/testify v1.3.0
 	gopkg.in/Clever/kayvee-go.v3 v3.2.1
 	gopkg.in/Clever/pathio.v3 v3.2.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
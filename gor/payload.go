@@ -0,0 +1,70 @@
+package gor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PayloadSeparator separates the requests in a gor capture file
+const PayloadSeparator = "\n🐵🙈🙉\n"
+
+// Payload types. Gor writes the response to a request with the same ID when tracking responses
+const (
+	RequestPayload  = "1"
+	ResponsePayload = "2"
+)
+
+// Payload is a request or response in a gor capture file
+type Payload struct {
+	Type string
+	ID   string
+	Time time.Time
+	Data []byte
+}
+
+// WriteRequest writes a raw HTTP request made at ts to w in the format of gor capture files
+func WriteRequest(w io.Writer, ts time.Time, request []byte) error {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s %s %d\n", RequestPayload, hex.EncodeToString(id), ts.UnixNano()); err != nil {
+		return err
+	}
+	if _, err := w.Write(request); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, PayloadSeparator)
+	return err
+}
+
+// ReadPayloads reads every payload in a gor capture file
+func ReadPayloads(r io.Reader) ([]Payload, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	payloads := []Payload{}
+	for i, chunk := range strings.Split(string(buf), PayloadSeparator) {
+		if strings.TrimSpace(chunk) == "" {
+			continue
+		}
+		parts := strings.SplitN(chunk, "\n", 2)
+		header := strings.Fields(parts[0])
+		if len(parts) != 2 || len(header) < 3 {
+			return nil, fmt.Errorf("payload %d has no header", i)
+		}
+		nanos, err := strconv.ParseInt(header[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("payload %d has an invalid timestamp %q", i, header[2])
+		}
+		payloads = append(payloads, Payload{Type: header[0], ID: header[1], Time: time.Unix(0, nanos), Data: []byte(parts[1])})
+	}
+	return payloads, nil
+}
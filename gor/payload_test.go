@@ -0,0 +1,33 @@
+package gor
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPayloads(t *testing.T) {
+	capture := "1 a 1464736200000000000\nGET /v1/users/1 HTTP/1.1\r\nHost: users.example.com\r\n\r\n" + PayloadSeparator +
+		"1 b 1464736201000000000\nPOST /v1/users HTTP/1.1\r\nHost: users.example.com\r\nContent-Length: 12\r\n\r\n{\"name\":\"a\"}" + PayloadSeparator +
+		"2 b 1464736201000000000 1000\nHTTP/1.1 201 Created\r\nContent-Length: 8\r\n\r\n{\"id\":2}" + PayloadSeparator
+	payloads, err := ReadPayloads(strings.NewReader(capture))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(payloads))
+	assert.Equal(t, Payload{
+		Type: RequestPayload,
+		ID:   "a",
+		Time: time.Unix(0, 1464736200000000000),
+		Data: []byte("GET /v1/users/1 HTTP/1.1\r\nHost: users.example.com\r\n\r\n"),
+	}, payloads[0])
+	assert.Equal(t, Payload{
+		Type: ResponsePayload,
+		ID:   "b",
+		Time: time.Unix(0, 1464736201000000000),
+		Data: []byte("HTTP/1.1 201 Created\r\nContent-Length: 8\r\n\r\n{\"id\":2}"),
+	}, payloads[2])
+
+	_, err = ReadPayloads(strings.NewReader("GET / HTTP/1.1\r\n\r\n" + PayloadSeparator))
+	assert.EqualError(t, err, `payload 0 has an invalid timestamp "HTTP/1.1"`)
+}
@@ -1,36 +1,32 @@
 package gor
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
-	"strings"
 
 	"github.com/Clever/http-science/config"
 )
 
-// RunGor runs gor on the file, sending requests to the local server
-func RunGor(file string, payload *config.Payload) error {
+// RunGor runs gor on the file, sending requests to the local server. Gor is killed if ctx is done
+func RunGor(ctx context.Context, file string, payload *config.Payload) error {
 	args := []string{
 		"--verbose",
 		"--debug",
 		"--input-file", fmt.Sprintf("%s|%d%%", file, payload.Speed),
 		"--output-http", "localhost:8000",
 	}
-	for _, v := range strings.Split(payload.Methods, ",") {
+	for _, v := range payload.Methods {
 		args = append(args, []string{"--http-allow-method", v}...)
 	}
-	if payload.DisallowURLRegex != "" {
-		for _, v := range strings.Split(payload.DisallowURLRegex, ",") {
-			args = append(args, []string{"--http-disallow-url", v}...)
-		}
+	for _, v := range payload.DisallowURLRegex {
+		args = append(args, []string{"--http-disallow-url", v}...)
 	}
-	if payload.AllowURLRegex != "" {
-		for _, v := range strings.Split(payload.AllowURLRegex, ",") {
-			args = append(args, []string{"--http-allow-url", v}...)
-		}
+	for _, v := range payload.AllowURLRegex {
+		args = append(args, []string{"--http-allow-url", v}...)
 	}
 
-	cmd := exec.Command("gor", args...)
+	cmd := exec.CommandContext(ctx, "gor", args...)
 	stdErr, err := cmd.StderrPipe()
 	if err != nil {
 		return err
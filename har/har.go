@@ -0,0 +1,286 @@
+package har
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/Clever/pathio.v3"
+
+	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/gor"
+	"github.com/Clever/http-science/science"
+)
+
+// HAR is an HTTP Archive, see http://www.softwareishard.com/blog/har-12-spec/.
+// Only the fields we read or write are included
+type HAR struct {
+	Log Log `json:"log"`
+}
+
+// Log is the root of a HAR
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+}
+
+// Creator is the application that wrote the HAR
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Entry is a single request and its response
+type Entry struct {
+	StartedDateTime string   `json:"startedDateTime"`
+	Time            float64  `json:"time"`
+	Request         Request  `json:"request"`
+	Response        Response `json:"response"`
+	Cache           struct{} `json:"cache"`
+	Timings         Timings  `json:"timings"`
+	Comment         string   `json:"comment,omitempty"`
+}
+
+// Request is the request of an entry
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []NameValue `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+// Response is the response of an entry
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []NameValue `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+// NameValue is a header, cookie or query string parameter
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PostData is the body of a request
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// Content is the body of a response
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// Timings is how long each phase of an entry took in milliseconds
+type Timings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Read parses a HAR
+func Read(r io.Reader) (*HAR, error) {
+	h := &HAR{}
+	if err := json.NewDecoder(r).Decode(h); err != nil {
+		return nil, fmt.Errorf("error parsing HAR: %s", err)
+	}
+	return h, nil
+}
+
+// HTTPRequest builds the entry's request
+func (e Entry) HTTPRequest() (*http.Request, error) {
+	body := ""
+	if e.Request.PostData != nil {
+		body = e.Request.PostData.Text
+	}
+	req, err := http.NewRequest(e.Request.Method, e.Request.URL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range e.Request.Headers {
+		// HTTP/2 pseudo headers like :authority aren't real headers, and the body may have been decoded
+		if strings.HasPrefix(h.Name, ":") || http.CanonicalHeaderKey(h.Name) == "Content-Length" {
+			continue
+		}
+		if http.CanonicalHeaderKey(h.Name) == "Host" {
+			req.Host = h.Value
+			continue
+		}
+		req.Header.Add(h.Name, h.Value)
+	}
+	if body != "" {
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return req, nil
+}
+
+// WriteGor writes the requests of the HAR's entries to w as a gor capture file so they can be
+// replayed, returning how many were written
+func WriteGor(h *HAR, w io.Writer) (int, error) {
+	// Entries without a start time are replayed one after another
+	ts := time.Now()
+	for i, e := range h.Log.Entries {
+		req, err := e.HTTPRequest()
+		if err != nil {
+			return i, fmt.Errorf("error building request of entry %d: %s", i, err)
+		}
+		dump, err := httputil.DumpRequest(req, true)
+		if err != nil {
+			return i, err
+		}
+		if started, err := time.Parse(time.RFC3339Nano, e.StartedDateTime); err == nil {
+			ts = started
+		} else {
+			ts = ts.Add(time.Millisecond)
+		}
+		if err := gor.WriteRequest(w, ts, dump); err != nil {
+			return i, err
+		}
+	}
+	return len(h.Log.Entries), nil
+}
+
+// FromDiffs builds a HAR with two entries for each diff, the request with the control's response
+// and the request with the experiment's, commented "control" and "experiment"
+func FromDiffs(diffs []science.Diff) (*HAR, error) {
+	h := &HAR{Log: Log{
+		Version: "1.2",
+		Creator: Creator{Name: "http-science", Version: "1"},
+		Entries: []Entry{},
+	}}
+	started := time.Now().UTC().Format(time.RFC3339Nano)
+	for i, d := range diffs {
+		req, err := toRequest(d.Request)
+		if err != nil {
+			return nil, fmt.Errorf("error reading request of diff %d: %s", i, err)
+		}
+		for _, which := range []struct{ comment, dump string }{{"control", d.Control}, {"experiment", d.Experiment}} {
+			h.Log.Entries = append(h.Log.Entries, Entry{
+				StartedDateTime: started,
+				Time:            -1,
+				Request:         req,
+				Response:        toResponse(which.dump),
+				Timings:         Timings{Send: -1, Wait: -1, Receive: -1},
+				Comment:         fmt.Sprintf("%s: %s differs in %s", which.comment, d.Route, strings.Join(d.Fields, ", ")),
+			})
+		}
+	}
+	return h, nil
+}
+
+// Loc returns where the HAR of a run's diffs is written: har_loc if set, otherwise next to the diff log
+func Loc(payload *config.Payload) string {
+	if payload.HARLoc != "" {
+		return payload.HARLoc
+	}
+	if payload.DiffLoc != "" {
+		return payload.DiffLoc + ".har"
+	}
+	return ""
+}
+
+// Write writes the HAR to loc, which can be s3 or a local path
+func Write(loc string, h *HAR) error {
+	buf, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return pathio.Write(loc, buf)
+}
+
+// toRequest parses a raw HTTP request from the diff log
+func toRequest(dump string) (Request, error) {
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(dump)))
+	if err != nil {
+		return Request{}, err
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Request{}, err
+	}
+	req := Request{
+		Method:      r.Method,
+		URL:         "http://" + r.Host + r.URL.RequestURI(),
+		HTTPVersion: r.Proto,
+		Cookies:     []NameValue{},
+		Headers:     nameValues(r.Header),
+		QueryString: []NameValue{},
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	req.Headers = append([]NameValue{{Name: "Host", Value: r.Host}}, req.Headers...)
+	for name, values := range r.URL.Query() {
+		for _, v := range values {
+			req.QueryString = append(req.QueryString, NameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(req.QueryString, func(i, j int) bool { return req.QueryString[i].Name < req.QueryString[j].Name })
+	if len(body) > 0 {
+		req.PostData = &PostData{MimeType: r.Header.Get("Content-Type"), Text: string(body)}
+	}
+	return req, nil
+}
+
+// toResponse parses a raw HTTP response from the diff log. Responses that failed to forward
+// are kept as a response with status 0 and the error as the body
+func toResponse(dump string) Response {
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(dump)), nil)
+	if err != nil {
+		return Response{
+			Cookies:     []NameValue{},
+			Headers:     []NameValue{},
+			Content:     Content{Size: len(dump), MimeType: "text/plain", Text: dump},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return Response{
+		Status:      res.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(res.Status, strconv.Itoa(res.StatusCode))),
+		HTTPVersion: res.Proto,
+		Cookies:     []NameValue{},
+		Headers:     nameValues(res.Header),
+		Content:     Content{Size: len(body), MimeType: res.Header.Get("Content-Type"), Text: string(body)},
+		RedirectURL: res.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+}
+
+func nameValues(header http.Header) []NameValue {
+	nvs := []NameValue{}
+	for name, values := range header {
+		for _, v := range values {
+			nvs = append(nvs, NameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(nvs, func(i, j int) bool { return nvs[i].Name < nvs[j].Name })
+	return nvs
+}
@@ -0,0 +1,108 @@
+package har
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/gor"
+	"github.com/Clever/http-science/science"
+)
+
+const browserHAR = `{
+  "log": {
+    "version": "1.2",
+    "creator": {"name": "WebInspector", "version": "537.36"},
+    "entries": [
+      {
+        "startedDateTime": "2016-05-31T23:10:00.123Z",
+        "request": {
+          "method": "GET",
+          "url": "https://api.example.com/v1/users/1?fields=name",
+          "httpVersion": "HTTP/2.0",
+          "headers": [
+            {"name": ":authority", "value": "api.example.com"},
+            {"name": "authorization", "value": "Bearer abc"}
+          ]
+        }
+      },
+      {
+        "startedDateTime": "2016-05-31T23:10:01Z",
+        "request": {
+          "method": "POST",
+          "url": "https://api.example.com/v1/users",
+          "httpVersion": "HTTP/1.1",
+          "headers": [{"name": "Content-Length", "value": "999"}],
+          "postData": {"mimeType": "application/json", "text": "{\"name\": \"ann\"}"}
+        }
+      }
+    ]
+  }
+}`
+
+func TestWriteGor(t *testing.T) {
+	h, err := Read(strings.NewReader(browserHAR))
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	n, err := WriteGor(h, &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	payloads := strings.Split(strings.TrimSuffix(buf.String(), gor.PayloadSeparator), gor.PayloadSeparator)
+	assert.Equal(t, 2, len(payloads))
+	header := strings.SplitN(payloads[0], "\n", 2)
+	assert.True(t, strings.HasPrefix(header[0], "1 "))
+	assert.True(t, strings.HasSuffix(header[0], " 1464736200123000000"))
+
+	get, err := http.ReadRequest(bufio.NewReader(strings.NewReader(header[1])))
+	assert.Nil(t, err)
+	assert.Equal(t, "/v1/users/1?fields=name", get.RequestURI)
+	assert.Equal(t, "api.example.com", get.Host)
+	assert.Equal(t, "Bearer abc", get.Header.Get("Authorization"))
+
+	post, err := http.ReadRequest(bufio.NewReader(strings.NewReader(strings.SplitN(payloads[1], "\n", 2)[1])))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), post.ContentLength)
+}
+
+func TestFromDiffs(t *testing.T) {
+	h, err := FromDiffs([]science.Diff{{
+		Route:          "GET /v1/users/:id",
+		ControlCode:    200,
+		ExperimentCode: -1,
+		Fields:         []string{"code", "body"},
+		Request:        "GET /v1/users/1?b=2&a=1 HTTP/1.1\r\nHost: localhost:8000\r\nAccept: */*\r\n\r\n",
+		Control:        "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n{\"id\": 1}",
+		Experiment:     "Error forwarding request Experiment",
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(h.Log.Entries))
+
+	control, experiment := h.Log.Entries[0], h.Log.Entries[1]
+	assert.Equal(t, "http://localhost:8000/v1/users/1?b=2&a=1", control.Request.URL)
+	assert.Equal(t, []NameValue{{"a", "1"}, {"b", "2"}}, control.Request.QueryString)
+	assert.Equal(t, []NameValue{{"Host", "localhost:8000"}, {"Accept", "*/*"}}, control.Request.Headers)
+	assert.Equal(t, "control: GET /v1/users/:id differs in code, body", control.Comment)
+	assert.Equal(t, 200, control.Response.Status)
+	assert.Equal(t, "OK", control.Response.StatusText)
+	assert.Equal(t, `{"id": 1}`, control.Response.Content.Text)
+	assert.Equal(t, 0, experiment.Response.Status)
+	assert.Equal(t, "Error forwarding request Experiment", experiment.Response.Content.Text)
+
+	// What we export can be replayed
+	var buf bytes.Buffer
+	n, err := WriteGor(h, &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestLoc(t *testing.T) {
+	assert.Equal(t, "s3://bucket/diffs.har", Loc(&config.Payload{DiffLoc: "s3://bucket/diffs"}))
+	assert.Equal(t, "/tmp/diffs.har", Loc(&config.Payload{DiffLoc: "s3://bucket/diffs", HARLoc: "/tmp/diffs.har"}))
+}
@@ -1,88 +1,256 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/Clever/http-science/auth"
+	"github.com/Clever/http-science/checkpoint"
 	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/difflog"
 	"github.com/Clever/http-science/email"
 	"github.com/Clever/http-science/getfiles"
 	"github.com/Clever/http-science/gor"
+	"github.com/Clever/http-science/har"
+	"github.com/Clever/http-science/record"
+	"github.com/Clever/http-science/report"
 	"github.com/Clever/http-science/science"
+	"github.com/Clever/http-science/stub"
+	"github.com/Clever/http-science/summary"
 	"github.com/Clever/http-science/validate"
 	"gopkg.in/Clever/kayvee-go.v3/logger"
 	"gopkg.in/Clever/pathio.v3"
 )
 
 func main() {
-	var err error
-	var handler http.Handler
+	// The worker passes the payload as a single JSON argument
+	if len(os.Args) == 2 && strings.HasPrefix(strings.TrimSpace(os.Args[1]), "{") {
+		payloadBuffer := []byte(os.Args[1])
+		payload := new(config.Payload)
 
-	if len(os.Args) != 2 {
-		config.LogAndExitIfErr(fmt.Errorf("Expected 2 args, got %d", len(os.Args)), "incorrect-number-args", os.Args)
+		err := json.Unmarshal(payloadBuffer, payload)
+		config.LogAndExitIfErr(err, "unmarshal-payload-failed", string(payloadBuffer))
+
+		run(payload)
 	}
-	payloadBuffer := []byte(os.Args[1])
-	payload := new(config.Payload)
+	os.Exit(runCLI(os.Args[1:]))
+}
 
-	err = json.Unmarshal(payloadBuffer, payload)
-	config.LogAndExitIfErr(err, "unmarshal-payload-failed", string(payloadBuffer))
+// run validates the payload and runs the job. It doesn't return, the process exits when the job is done
+func run(payload *config.Payload) {
+	var err error
+	var handler http.Handler
 
 	payload, err = validate.Payload(payload)
 	config.LogAndExitIfErr(err, "invalid-payload", payload)
+	if payload.JobType == "record" {
+		runRecord(payload)
+	}
+
+	if payload.StubAddr != "" {
+		err = startStubs(payload)
+		config.LogAndExitIfErr(err, "starting-stub-server-failed", payload)
+	}
+
+	var cp *checkpoint.Checkpoint
+	if payload.Resume {
+		cp, err = checkpoint.Load(payload.CheckpointLoc)
+		config.LogAndExitIfErr(err, "loading-checkpoint-failed", payload)
+		if cp == nil {
+			config.KV.InfoD("no-checkpoint-starting-fresh", logger.M{"checkpoint_loc": payload.CheckpointLoc})
+		}
+	}
 
 	switch payload.JobType {
 	case "load":
-		handler = setupLoad(payload)
+		handler, err = setupLoad(payload, cp)
 	case "correctness":
-		handler, err = setupCorrectness(payload)
+		handler, err = setupCorrectness(payload, cp)
 	}
 	config.LogAndExitIfErr(err, "setup-failed", payload)
 
-	doScience(handler, payload)
+	doScience(handler, payload, cp)
 }
 
-// setupCorrectness returns the handler for a correctness test
-func setupCorrectness(payload *config.Payload) (http.Handler, error) {
-	f, err := ioutil.TempFile(os.TempDir(), "")
+// setupCorrectness returns the handler for a correctness test, continuing from the checkpoint if there is one
+func setupCorrectness(payload *config.Payload, cp *checkpoint.Checkpoint) (http.Handler, error) {
+	chunks := []string{}
+	if cp != nil {
+		chunks = cp.DiffLogChunks
+	}
+	f, err := difflog.Resume(payload.DiffLoc, payload.DiffChunkBytes, chunks)
 	if err != nil {
 		return nil, err
 	}
+	f.RotateEvery(time.Duration(payload.DiffUploadInterval) * time.Second)
 
 	science.Res = science.Results{
 		Reqs:    0,
+		MaxReqs: payload.Reqs,
 		Codes:   map[int]map[int]int{},
 		Mutex:   &sync.Mutex{},
 		Diffs:   0,
 		DiffLog: f,
+		Noise:   map[string]int{},
+	}
+	restoreResults(cp)
+	controlRewriter, err := science.NewRewriter(payload.Rewrite, payload.RewriteControl)
+	if err != nil {
+		return nil, err
+	}
+	experimentRewriter, err := science.NewRewriter(payload.Rewrite, payload.RewriteExperiment)
+	if err != nil {
+		return nil, err
+	}
+	controlAuth, err := auth.New(targetAuth(payload.Auth, payload.AuthControl))
+	if err != nil {
+		return nil, err
+	}
+	experimentAuth, err := auth.New(targetAuth(payload.Auth, payload.AuthExperiment))
+	if err != nil {
+		return nil, err
+	}
+	filter, err := science.NewFilter(payload.Filter)
+	if err != nil {
+		return nil, err
+	}
+	selector := science.NewSelector(payload.Selection)
+	selector.Restore(&science.Res)
+	redactor, err := science.NewRedactor(payload.Redact)
+	if err != nil {
+		return nil, err
 	}
 	handler := science.CorrectnessTest{
-		ControlURL:    payload.ControlURL,
-		ExperimentURL: payload.ExperimentURL,
+		ControlURL:         payload.ControlURL,
+		ExperimentURL:      payload.ExperimentURL,
+		Control2URL:        payload.Control2URL,
+		ControlRewriter:    controlRewriter,
+		ExperimentRewriter: experimentRewriter,
+		ControlAuth:        controlAuth,
+		ExperimentAuth:     experimentAuth,
+		Redactor:           redactor,
+		DryRun:             payload.DryRun,
+		DryRunURL:          payload.DryRunURL,
+		Filter:             filter,
+		Selector:           selector,
 	}
 	return handler, nil
 }
 
-// setupLoad returns the handler for a load test
-func setupLoad(payload *config.Payload) http.Handler {
+// setupLoad returns the handler for a load test, continuing from the checkpoint if there is one
+func setupLoad(payload *config.Payload, cp *checkpoint.Checkpoint) (http.Handler, error) {
 	science.Res = science.Results{
-		Reqs:  0,
-		Mutex: &sync.Mutex{},
+		Reqs:    0,
+		MaxReqs: payload.Reqs,
+		Mutex:   &sync.Mutex{},
 	}
+	restoreResults(cp)
+	rewriter, err := science.NewRewriter(payload.Rewrite)
+	if err != nil {
+		return nil, err
+	}
+	loadAuth, err := auth.New(payload.Auth)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := science.NewFilter(payload.Filter)
+	if err != nil {
+		return nil, err
+	}
+	selector := science.NewSelector(payload.Selection)
+	selector.Restore(&science.Res)
 	handler := science.LoadTest{
-		URL: payload.LoadURL,
+		URL:       payload.LoadURL,
+		Rewriter:  rewriter,
+		Auth:      loadAuth,
+		DryRunURL: payload.DryRunURL,
+		Filter:    filter,
+		Selector:  selector,
 	}
-	return handler
+	return handler, nil
+}
+
+// dryRunTarget returns where a dry run sends writes
+func dryRunTarget(payload *config.Payload) string {
+	if payload.DryRunURL != "" {
+		return payload.DryRunURL
+	}
+	if payload.JobType == "load" {
+		return payload.LoadURL
+	}
+	return payload.ExperimentURL
+}
+
+// targetAuth returns the auth config of a target, which replaces the one shared by every target if set
+func targetAuth(shared, target config.Auth) config.Auth {
+	if !target.IsEmpty() {
+		return target
+	}
+	return shared
+}
+
+// stubs is the stub server if the payload has stub_addr
+var stubs *stub.Server
+
+// startStubs starts the stub server that serves the payload's stubs to the targets' downstream requests
+func startStubs(payload *config.Payload) error {
+	var err error
+	if stubs, err = stub.New(payload); err != nil {
+		return err
+	}
+	go func() {
+		err := http.ListenAndServe(payload.StubAddr, stubs)
+		config.LogAndExitIfErr(err, "stub-server-crashed", nil)
+	}()
+	config.KV.InfoD("stub-server-started", logger.M{"stub_addr": payload.StubAddr, "stubs": len(payload.Stubs), "stub_files": payload.StubFiles})
+	return nil
 }
 
+// runRecord proxies traffic to record_url, writing it into capture files until interrupted
+func runRecord(payload *config.Payload) {
+	rec, err := record.New(payload)
+	config.LogAndExitIfErr(err, "setup-failed", payload)
+	rec.RotateEvery(time.Minute)
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		config.KV.InfoD("interrupted", logger.M{"signal": sig.String()})
+		err := rec.Close()
+		config.LogAndExitIfErr(err, "uploading-capture-file-failed", nil)
+		config.KV.InfoD("recording-finished", logger.M{"files": rec.Files()})
+		os.Exit(config.ExitPass)
+	}()
+
+	config.KV.InfoD("recording", logger.M{"listen_addr": payload.ListenAddr, "record_url": payload.RecordURL, "capture_loc": payload.CaptureLoc})
+	err = http.ListenAndServe(payload.ListenAddr, rec)
+	config.LogAndExitIfErr(err, "server-crashed", nil)
+}
+
+// drainTimeout is how long we wait for in flight requests when interrupted
+const drainTimeout = 30 * time.Second
+
+// finishing is held by whichever exit path runs first so results are only logged once.
+// It is never unlocked, the process exits instead
+var finishing = &sync.Mutex{}
+
 // doScience sends the stored requests to the provided handler
-func doScience(handler http.Handler, payload *config.Payload) {
+func doScience(handler http.Handler, payload *config.Payload, cp *checkpoint.Checkpoint) {
 	startTime := time.Now()
+	prog := newProgress(cp)
+	ctx, stopGor := context.WithCancel(context.Background())
+	go handleSignals(startTime, payload, prog, stopGor)
+	go finishAtReqs(startTime, payload, stopGor)
 
 	// Start up server to handle the requests coming from gor
 	go func() {
@@ -90,74 +258,231 @@ func doScience(handler http.Handler, payload *config.Payload) {
 		config.LogAndExitIfErr(err, "server-crashed", nil)
 	}()
 
+	if payload.CheckpointLoc != "" {
+		go saveCheckpoints(payload, prog)
+	}
+
 	// Keep a 10 file buffer for gor
-	files := make(chan string, 10)
+	files := make(chan getfiles.File, 10)
 	go func() {
-		err := getfiles.AddFilesToChan(payload, files)
+		err := getfiles.AddFilesToChan(payload, files, prog.skip())
 		config.LogAndExitIfErr(err, "getting-files-failed", nil)
-		// Out of files. Wait until chan empty and then exit
-		waitAndExit(startTime, files, payload)
+		close(files)
 	}()
 
 	// Run gor on those files
-	for {
-		curFile := <-files
-		err := gor.RunGor(curFile, payload)
+	for curFile := range files {
+		prog.start(curFile.Remote)
+		err := gor.RunGor(ctx, curFile.Local, payload)
+		if ctx.Err() != nil {
+			// Interrupted or reqs reached, handleSignals or finishAtReqs takes it from here
+			select {}
+		}
 		config.LogAndExitIfErr(err, "gor-failed", nil)
+		prog.finish()
+		science.Res.Mutex.Lock()
+		reqs, diffs := science.Res.Reqs, science.Res.Diffs
+		science.Res.Mutex.Unlock()
 		config.KV.InfoD("progress", logger.M{
 			"exp_url":      payload.ExperimentURL,
 			"control_url":  payload.ControlURL,
 			"load_url":     payload.LoadURL,
-			"reqs":         science.Res.Reqs,
-			"diffs":        science.Res.Diffs,
-			"last_gorfile": curFile,
+			"reqs":         reqs,
+			"diffs":        diffs,
+			"last_gorfile": curFile.Remote,
 		})
-		if science.Res.Reqs >= payload.Reqs {
-			err := logResults(startTime, payload)
-			config.LogAndExitIfErr(err, "logging-results-failed", nil)
-			os.Exit(0)
+	}
+	// Out of files and gor replayed the last one
+	waitAndExit(startTime, payload, stopGor)
+}
+
+// finishAtReqs stops the job once payload.Reqs requests have been forwarded. Requests past the limit
+// are dropped as they arrive, so it stops gor and waits for the requests in flight to finish first
+func finishAtReqs(startTime time.Time, payload *config.Payload, stopGor context.CancelFunc) {
+	<-science.Res.ReqsReached()
+
+	finishing.Lock()
+	stopGor()
+	science.Drain()
+	if !science.WaitInFlight(drainTimeout) {
+		config.KV.ErrorD("drain-timed-out", logger.M{"timeout": drainTimeout.String()})
+	}
+	code, err := logResults(startTime, payload, summary.ExitReqsReached)
+	config.LogAndExitIfErr(err, "logging-results-failed", nil)
+	os.Exit(code)
+}
+
+// handleSignals stops the job on SIGTERM or SIGINT: it stops replaying, waits for in flight requests
+// and logs the results so far as partial. If checkpointing, a final checkpoint is saved to resume from
+func handleSignals(startTime time.Time, payload *config.Payload, prog *progress, stopGor context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+
+	finishing.Lock()
+	config.KV.InfoD("interrupted", logger.M{"signal": sig.String()})
+	stopGor()
+	science.Drain()
+	if !science.WaitInFlight(drainTimeout) {
+		config.KV.ErrorD("drain-timed-out", logger.M{"timeout": drainTimeout.String()})
+	}
+	if payload.CheckpointLoc != "" {
+		if err := saveCheckpoint(payload, prog); err != nil {
+			config.KV.ErrorD("saving-checkpoint-failed", logger.M{"error": err.Error()})
 		}
 	}
+	code, err := logResults(startTime, payload, summary.ExitInterrupted)
+	config.LogAndExitIfErr(err, "interrupted-logging-results-failed", nil)
+	os.Exit(code)
 }
 
-func waitAndExit(startTime time.Time, files chan string, payload *config.Payload) {
-	for len(files) > 0 {
-		time.Sleep(1 * time.Second)
+// waitAndExit finishes the job once every file has been replayed. Like the other ways a job finishes it
+// waits for the requests in flight, so the results and diff log are complete
+func waitAndExit(startTime time.Time, payload *config.Payload, stopGor context.CancelFunc) {
+	finishing.Lock()
+	stopGor()
+	science.Drain()
+	if !science.WaitInFlight(drainTimeout) {
+		config.KV.ErrorD("drain-timed-out", logger.M{"timeout": drainTimeout.String()})
 	}
-	err := logResults(startTime, payload)
+	science.Res.Mutex.Lock()
+	reqs := science.Res.Reqs
+	science.Res.Mutex.Unlock()
+	config.KV.InfoD("out-of-files", logger.M{"reqs": reqs, "wanted_reqs": payload.Reqs})
+	code, err := logResults(startTime, payload, summary.ExitOutOfFiles)
 	config.LogAndExitIfErr(err, "no-files-logging-results-failed", nil)
-	config.LogAndExitIfErr(fmt.Errorf("Ran out of files"), "out-of-files", nil)
+	os.Exit(code)
 }
 
-func logResults(startTime time.Time, payload *config.Payload) error {
-	log.Printf("%d reqs in %v seconds", science.Res.Reqs, time.Since(startTime))
+// logResults logs and uploads the results and returns the code to exit with. reason is why the job finished
+func logResults(startTime time.Time, payload *config.Payload, reason string) (int, error) {
+	if reason == summary.ExitInterrupted {
+		log.Printf("Job interrupted, results are partial")
+	}
+	// Counts are read from the summary, which is built holding science.Res.Mutex
+	sum := summary.Build(payload, &science.Res, startTime, time.Now(), reason)
+	verdict := summary.Evaluate(sum, payload.Thresholds)
+	log.Printf("%d reqs in %v seconds", sum.Reqs, time.Since(startTime))
+	logRoutes()
+	if sum.Filtered > 0 {
+		log.Printf("Filtered out %d requests", sum.Filtered)
+	}
+	if sum.Unselected > 0 {
+		log.Printf("Skipped %d requests as duplicates or over the per route limit", sum.Unselected)
+	}
+	logCoverage()
+	if stubs != nil {
+		served, unmatched := stubs.Stats()
+		log.Printf("Stub server served %d requests, %d matched no stub", served, unmatched)
+	}
+	if payload.DryRun {
+		log.Printf("Dry run: %d writes were only sent to %s and not compared", sum.DryRunWrites, dryRunTarget(payload))
+	}
+	log.Printf("Verdict: %s, exit code %d", verdict.Result, verdict.ExitCode)
+	for _, failure := range verdict.Failures {
+		log.Printf("Threshold failed: %s", failure)
+	}
 
 	if payload.JobType == "correctness" {
 		science.Res.Mutex.Lock()
 		log.Printf("Results %#v", science.Res.Codes)
+		if payload.Control2URL != "" {
+			log.Printf("Noise between controls by field %#v", science.Res.Noise)
+		}
 		science.Res.Mutex.Unlock()
-		log.Printf("%d Diffs using weak compare: %t", science.Res.Diffs, config.WeakCompare)
+		log.Printf("%d Diffs using weak compare: %t", sum.Diffs, config.WeakCompare)
+
+		err := logNoise(payload)
+		config.LogAndExitIfErr(err, "logging-noise-failed", nil)
+
+		if config.DiffSampleSize > 0 {
+			log.Printf("Kept up to %d diffs per route and status code pair, dropped %d", config.DiffSampleSize, sum.DroppedDiffs)
+		}
+		err = science.Res.FlushSamples(config.DiffSampleSize)
+		config.LogAndExitIfErr(err, "flushing-diff-samples-failed", nil)
 
-		// Assert difflog is a file - we use the fact that it is a ReadWriter in the tests
-		diffLog, ok := science.Res.DiffLog.(*os.File)
+		// Assert difflog is a chunked writer - the tests use a bytes.Buffer
+		diffLog, ok := science.Res.DiffLog.(*difflog.Writer)
 		if !ok {
-			config.LogAndExitIfErr(fmt.Errorf("Could not assert to be file"), "type-assertion-failed", nil)
+			config.LogAndExitIfErr(fmt.Errorf("Could not assert to be difflog writer"), "type-assertion-failed", nil)
 		}
-		// Close to prevent data being written during the request
-		err := diffLog.Close()
-		config.LogAndExitIfErr(err, "closing-file-failed", nil)
-		// Open for reading
-		diffLog, err = os.Open(diffLog.Name())
-		config.LogAndExitIfErr(err, "open-difflog-failed", nil)
-		err = pathio.WriteReader(payload.DiffLoc, diffLog)
-		config.LogAndExitIfErr(err, "pathio-write-failed", nil)
+		science.Res.Mutex.Lock()
+		// Close while holding the lock to prevent data being written during the request
+		manifest, err := diffLog.Close(sum)
+		science.Res.Mutex.Unlock()
+		config.LogAndExitIfErr(err, "closing-difflog-failed", nil)
+		log.Printf("Uploaded %d diff log chunks, manifest at %s", len(manifest.Chunks), difflog.ManifestLoc(payload.DiffLoc))
+
+		diffs := science.Res.SampledDiffs()
+		err = report.Write(report.Loc(payload), sum, diffs)
+		config.LogAndExitIfErr(err, "writing-report-failed", nil)
+		log.Printf("Wrote report to %s", report.Loc(payload))
+
+		diffsHAR, err := har.FromDiffs(diffs)
+		config.LogAndExitIfErr(err, "building-har-failed", nil)
+		err = har.Write(har.Loc(payload), diffsHAR)
+		config.LogAndExitIfErr(err, "writing-har-failed", nil)
+		log.Printf("Wrote HAR of diffs to %s", har.Loc(payload))
+	}
+
+	if loc := summary.Loc(payload); loc != "" {
+		err := summary.Write(loc, sum)
+		config.LogAndExitIfErr(err, "writing-summary-failed", nil)
+		log.Printf("Wrote summary to %s", loc)
 	}
 
 	if payload.Email != "" {
 		err := email.SendEmail(payload, time.Since(startTime), science.Res)
 		if err != nil {
-			return err
+			return config.ExitError, err
 		}
 	}
-	return nil
+	return verdict.ExitCode, nil
+}
+
+// logNoise logs the diffs grouped into likely noise and likely regressions, and writes a config
+// that would ignore the noise next to the diff log
+func logNoise(payload *config.Payload) error {
+	report := science.Res.LearnedNoise()
+	for _, f := range report.LikelyNoise {
+		log.Printf("Likely noise: %s %s differed in %d/%d reqs", f.Endpoint, f.Field, f.Diffs, f.Reqs)
+	}
+	for _, f := range report.LikelyRegression {
+		log.Printf("Likely regression: %s %s differed in %d/%d reqs", f.Endpoint, f.Field, f.Diffs, f.Reqs)
+	}
+
+	suggested, err := json.MarshalIndent(report.Suggested, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Printf("Suggested config for the next run: %s", suggested)
+	return pathio.Write(payload.DiffLoc+".suggested-config.json", suggested)
+}
+
+// logCoverage logs how many of the routes in the capture were replayed, and the ones that weren't
+func logCoverage() {
+	covered, skipped := science.Res.Coverage()
+	log.Printf("Covered %d of %d routes seen", len(covered), len(covered)+len(skipped))
+	for _, s := range skipped {
+		log.Printf("Route %s was seen %d times but not replayed", s.Route, s.Seen)
+	}
+}
+
+// logRoutes logs the requests, diffs, errors and latency of each route, most diffs first
+func logRoutes() {
+	for _, route := range science.Res.SortedRoutes() {
+		science.Res.Mutex.Lock()
+		stats := science.Res.Routes[route]
+		log.Printf("Route %s: %d reqs, %d diffs (%.1f%%), %d errors (%.1f%%), latency mean %v p99 %v, control latency mean %v p99 %v",
+			route, stats.Reqs, stats.Diffs, percent(stats.Diffs, stats.Reqs), stats.Errors, percent(stats.Errors, stats.Reqs),
+			stats.Latency.Mean(), stats.Latency.Percentile(99), stats.ControlLatency.Mean(), stats.ControlLatency.Percentile(99))
+		science.Res.Mutex.Unlock()
+	}
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
 }
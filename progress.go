@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+
+	"github.com/Clever/http-science/checkpoint"
+	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/difflog"
+	"github.com/Clever/http-science/science"
+)
+
+// progress tracks which capture files have been replayed so it can be checkpointed
+type progress struct {
+	mutex     *sync.Mutex
+	processed []string
+	current   string
+	// currentStart is science.Res.Received when the current file started
+	currentStart int
+	// resumeFile is the file that was being replayed when the checkpoint we resumed from was taken
+	resumeFile   string
+	resumeOffset int
+}
+
+// newProgress returns the progress of a new job, or of the job the checkpoint was taken from
+func newProgress(cp *checkpoint.Checkpoint) *progress {
+	p := &progress{mutex: &sync.Mutex{}, processed: []string{}}
+	if cp != nil {
+		p.processed = cp.ProcessedFiles
+		p.resumeFile = cp.CurrentFile
+		p.resumeOffset = cp.CurrentFileOffset
+	}
+	return p
+}
+
+// skip returns the set of files that were already replayed in full
+func (p *progress) skip() map[string]bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	skip := map[string]bool{}
+	for _, f := range p.processed {
+		skip[f] = true
+	}
+	return skip
+}
+
+// start records that file is being replayed. If it is the file we resumed in the middle of,
+// the requests that were already replayed are skipped
+func (p *progress) start(file string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	science.Res.Mutex.Lock()
+	defer science.Res.Mutex.Unlock()
+	p.current = file
+	p.currentStart = science.Res.Received
+	if file == p.resumeFile {
+		science.Res.Skip = p.resumeOffset
+		p.currentStart -= p.resumeOffset
+	}
+}
+
+// finish records that the current file has been replayed in full
+func (p *progress) finish() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.processed = append(p.processed, p.current)
+	p.current = ""
+}
+
+// restoreResults continues the results of the job the checkpoint was taken from
+func restoreResults(cp *checkpoint.Checkpoint) {
+	if cp == nil {
+		return
+	}
+	res := cp.Results
+	res.Mutex, res.DiffLog, res.MaxReqs = science.Res.Mutex, science.Res.DiffLog, science.Res.MaxReqs
+	if res.Codes == nil {
+		res.Codes = science.Res.Codes
+	}
+	science.Res = res
+}
+
+// saveCheckpoints periodically checkpoints the job to payload.CheckpointLoc
+func saveCheckpoints(payload *config.Payload, p *progress) {
+	for range time.Tick(time.Duration(payload.CheckpointInterval) * time.Second) {
+		if err := saveCheckpoint(payload, p); err != nil {
+			config.KV.ErrorD("saving-checkpoint-failed", logger.M{"error": err.Error()})
+		}
+	}
+}
+
+func saveCheckpoint(payload *config.Payload, p *progress) error {
+	// Hold new requests until the ones in flight finish, so the offset in the current file only
+	// covers requests whose results are recorded
+	if !science.Pause(drainTimeout) {
+		return fmt.Errorf("requests were still in flight after %v", drainTimeout)
+	}
+	buf, diffLog, err := snapshot(p)
+	science.Resume()
+	if err != nil {
+		return err
+	}
+
+	// Upload the diffs the checkpoint refers to before writing it
+	if diffLog != nil {
+		if err := diffLog.Upload(); err != nil {
+			return err
+		}
+	}
+	return checkpoint.Write(payload.CheckpointLoc, buf)
+}
+
+// snapshot encodes the checkpoint of the job and returns the diff log whose chunks it refers to, if
+// there is one. Requests must be paused
+func snapshot(p *progress) ([]byte, *difflog.Writer, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	science.Res.Mutex.Lock()
+	defer science.Res.Mutex.Unlock()
+
+	chunks := []string{}
+	diffLog, ok := science.Res.DiffLog.(*difflog.Writer)
+	if ok {
+		var err error
+		if chunks, err = diffLog.Snapshot(); err != nil {
+			return nil, nil, err
+		}
+	}
+	cp := &checkpoint.Checkpoint{
+		Time:           time.Now(),
+		ProcessedFiles: p.processed,
+		CurrentFile:    p.current,
+		DiffLogChunks:  chunks,
+		Results:        science.Res,
+	}
+	if p.current != "" {
+		cp.CurrentFileOffset = science.Res.Received - p.currentStart
+	}
+	buf, err := checkpoint.Encode(cp)
+	if !ok {
+		diffLog = nil
+	}
+	return buf, diffLog, err
+}
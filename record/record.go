@@ -0,0 +1,278 @@
+package record
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+	"gopkg.in/Clever/pathio.v3"
+
+	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/gor"
+)
+
+// Recorder is a reverse proxy that writes the requests it forwards into gor capture files.
+// A file is started every hour and uploaded to <capture_loc>/yyyy/mm/dd/hh/ once it is rotated,
+// the layout getfiles replays from
+type Recorder struct {
+	loc        string
+	instance   string
+	sampleRate float64
+	methods    map[string]bool
+	allow      []*regexp.Regexp
+	disallow   []*regexp.Regexp
+	proxy      http.Handler
+	now        func() time.Time
+
+	mutex *sync.Mutex
+	start time.Time
+	file  *os.File
+	gz    *gzip.Writer
+	count int
+	// files are the uploaded capture files, pending the rotated ones waiting to be uploaded
+	files   []string
+	pending []capture
+	// uploading is held while uploading so a slow upload doesn't hold up the requests being proxied
+	uploading *sync.Mutex
+	done      chan struct{}
+}
+
+// capture is a rotated capture file's local file and where it is uploaded to
+type capture struct {
+	file string
+	loc  string
+	reqs int
+}
+
+// New returns a Recorder that forwards to the payload's record_url and records the requests that
+// pass its sample rate and method and URL filters
+func New(payload *config.Payload) (*Recorder, error) {
+	target, err := url.Parse(payload.RecordURL)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recorder{
+		loc: payload.CaptureLoc,
+		// getfiles names downloaded files by everything before the first dot
+		instance:   strings.Replace(instance, ".", "-", -1),
+		sampleRate: payload.RecordSampleRate,
+		methods:    map[string]bool{},
+		proxy:      httputil.NewSingleHostReverseProxy(target),
+		now:        time.Now,
+		mutex:      &sync.Mutex{},
+		uploading:  &sync.Mutex{},
+		done:       make(chan struct{}),
+	}
+	for _, m := range payload.Methods {
+		rec.methods[strings.ToUpper(m)] = true
+	}
+	for _, r := range payload.AllowURLRegex {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, err
+		}
+		rec.allow = append(rec.allow, re)
+	}
+	for _, r := range payload.DisallowURLRegex {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, err
+		}
+		rec.disallow = append(rec.disallow, re)
+	}
+	return rec, nil
+}
+
+func (rec *Recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rec.shouldRecord(r) {
+		// DumpRequest restores the body so it can still be forwarded
+		dump, err := httputil.DumpRequest(r, true)
+		if err != nil {
+			config.KV.ErrorD("dumping-request-failed", logger.M{"error": err.Error()})
+		} else if err := rec.write(dump); err != nil {
+			config.KV.ErrorD("recording-request-failed", logger.M{"error": err.Error()})
+		}
+	}
+	rec.proxy.ServeHTTP(w, r)
+}
+
+// shouldRecord returns true if the request passes the filters and is sampled
+func (rec *Recorder) shouldRecord(r *http.Request) bool {
+	if len(rec.methods) > 0 && !rec.methods[r.Method] {
+		return false
+	}
+	uri := r.URL.RequestURI()
+	for _, re := range rec.disallow {
+		if re.MatchString(uri) {
+			return false
+		}
+	}
+	allowed := len(rec.allow) == 0
+	for _, re := range rec.allow {
+		allowed = allowed || re.MatchString(uri)
+	}
+	return allowed && (rec.sampleRate >= 1 || rand.Float64() < rec.sampleRate)
+}
+
+// write appends the raw request to the capture file for the current hour
+func (rec *Recorder) write(dump []byte) error {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	now := rec.now()
+	if rec.file != nil && !sameHour(rec.start, now) {
+		if err := rec.rotate(); err != nil {
+			return err
+		}
+		go rec.uploadAndLog()
+	}
+	if rec.file == nil {
+		if err := rec.openFile(now); err != nil {
+			return err
+		}
+	}
+	if err := gor.WriteRequest(rec.gz, now, dump); err != nil {
+		return err
+	}
+	rec.count++
+	return nil
+}
+
+func (rec *Recorder) openFile(now time.Time) error {
+	f, err := ioutil.TempFile(os.TempDir(), "")
+	if err != nil {
+		return err
+	}
+	rec.file, rec.gz, rec.start, rec.count = f, gzip.NewWriter(f), now, 0
+	return nil
+}
+
+// rotate closes the current capture file and queues it to be uploaded if it has any requests. rec.mutex must be held
+func (rec *Recorder) rotate() error {
+	name := rec.file.Name()
+	gzErr := rec.gz.Close()
+	fileErr := rec.file.Close()
+	rec.file, rec.gz = nil, nil
+	if gzErr != nil {
+		os.Remove(name)
+		return gzErr
+	} else if fileErr != nil {
+		os.Remove(name)
+		return fileErr
+	}
+	if rec.count == 0 {
+		os.Remove(name)
+		return nil
+	}
+	loc := fmt.Sprintf("%s%s%s-%d.gz", rec.loc, rec.start.UTC().Format("2006/01/02/15/"), rec.instance, rec.start.UnixNano())
+	rec.pending = append(rec.pending, capture{file: name, loc: loc, reqs: rec.count})
+	return nil
+}
+
+// upload uploads the rotated capture files in order, removing each locally once it is uploaded. If one
+// fails it and the files after it are kept locally and retried on the next upload
+func (rec *Recorder) upload() error {
+	rec.uploading.Lock()
+	defer rec.uploading.Unlock()
+	for {
+		rec.mutex.Lock()
+		if len(rec.pending) == 0 {
+			rec.mutex.Unlock()
+			return nil
+		}
+		c := rec.pending[0]
+		rec.mutex.Unlock()
+
+		if err := uploadFile(c); err != nil {
+			return fmt.Errorf("error uploading capture file %s, it is kept at %s: %s", c.loc, c.file, err)
+		}
+		os.Remove(c.file)
+		rec.mutex.Lock()
+		rec.pending = rec.pending[1:]
+		rec.files = append(rec.files, c.loc)
+		rec.mutex.Unlock()
+		config.KV.InfoD("capture-file-uploaded", logger.M{"loc": c.loc, "reqs": c.reqs})
+	}
+}
+
+func (rec *Recorder) uploadAndLog() {
+	if err := rec.upload(); err != nil {
+		config.KV.ErrorD("uploading-capture-file-failed", logger.M{"error": err.Error()})
+	}
+}
+
+func uploadFile(c capture) error {
+	f, err := os.Open(c.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pathio.WriteReader(c.loc, f)
+}
+
+// Files returns the capture files that have been uploaded so far
+func (rec *Recorder) Files() []string {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	return append([]string{}, rec.files...)
+}
+
+// RotateEvery checks on an interval whether the hour has passed, uploading the capture file if it has,
+// so files are uploaded even when no requests come in. It stops once the Recorder is closed
+func (rec *Recorder) RotateEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rec.mutex.Lock()
+				var err error
+				if rec.file != nil && !sameHour(rec.start, rec.now()) {
+					err = rec.rotate()
+				}
+				rec.mutex.Unlock()
+				if err != nil {
+					config.KV.ErrorD("rotating-capture-file-failed", logger.M{"error": err.Error()})
+				}
+				// Also retries files that failed to upload
+				rec.uploadAndLog()
+			case <-rec.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close uploads the current capture file and any that failed to upload before. If one can't be
+// uploaded the error says where it is kept locally
+func (rec *Recorder) Close() error {
+	rec.mutex.Lock()
+	close(rec.done)
+	var err error
+	if rec.file != nil {
+		err = rec.rotate()
+	}
+	rec.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return rec.upload()
+}
+
+func sameHour(a, b time.Time) bool {
+	return a.UTC().Truncate(time.Hour).Equal(b.UTC().Truncate(time.Hour))
+}
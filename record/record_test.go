@@ -0,0 +1,121 @@
+package record
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/gor"
+)
+
+func readCapture(t *testing.T, file string) string {
+	f, err := os.Open(file)
+	assert.Nil(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	buf, err := ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+	return string(buf)
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	}))
+	defer target.Close()
+
+	rec, err := New(&config.Payload{
+		RecordURL:        target.URL,
+		CaptureLoc:       dir + "/",
+		RecordSampleRate: 1,
+		Methods:          config.StringList{"GET", "POST"},
+		DisallowURLRegex: config.StringList{"^/health"},
+	})
+	assert.Nil(t, err)
+	now := time.Date(2016, 5, 31, 23, 10, 0, 0, time.UTC)
+	rec.now = func() time.Time { return now }
+
+	send := func(method, path, body string) string {
+		w := httptest.NewRecorder()
+		rec.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Body.String()
+	}
+	// Requests are forwarded whether or not they are recorded
+	assert.Equal(t, "POST /users hello", send("POST", "/users", "hello"))
+	assert.Equal(t, "GET /health ", send("GET", "/health", ""))
+	assert.Equal(t, "DELETE /users/1 ", send("DELETE", "/users/1", ""))
+	// A new file is started in the next hour
+	now = now.Add(time.Hour)
+	send("GET", "/users/1", "")
+	assert.Nil(t, rec.Close())
+
+	files := rec.Files()
+	assert.Equal(t, 2, len(files))
+	assert.True(t, strings.HasPrefix(files[0], filepath.Join(dir, "2016/05/31/23")+"/"))
+	assert.True(t, strings.HasPrefix(files[1], filepath.Join(dir, "2016/06/01/00")+"/"))
+
+	first := readCapture(t, files[0])
+	assert.Equal(t, 1, strings.Count(first, gor.PayloadSeparator))
+	assert.True(t, strings.HasPrefix(first, "1 "))
+	assert.Contains(t, first, "POST /users HTTP/1.1\r\n")
+	assert.Contains(t, first, "\r\n\r\nhello"+gor.PayloadSeparator)
+	assert.Contains(t, readCapture(t, files[1]), "GET /users/1 HTTP/1.1\r\n")
+}
+
+func TestSampleRate(t *testing.T) {
+	rec, err := New(&config.Payload{RecordURL: "http://localhost", RecordSampleRate: 0.5})
+	assert.Nil(t, err)
+	recorded := 0
+	for i := 0; i < 1000; i++ {
+		if rec.shouldRecord(httptest.NewRequest("GET", "/", nil)) {
+			recorded++
+		}
+	}
+	assert.InDelta(t, 500, recorded, 100)
+}
+
+func TestRecorderUploadFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	// A file where the capture files' directory should be makes uploads fail
+	blocker := filepath.Join(dir, "captures")
+	assert.Nil(t, ioutil.WriteFile(blocker, []byte{}, 0644))
+
+	rec, err := New(&config.Payload{RecordURL: target.URL, CaptureLoc: blocker + "/", RecordSampleRate: 1})
+	assert.Nil(t, err)
+	now := time.Date(2016, 5, 31, 23, 10, 0, 0, time.UTC)
+	rec.now = func() time.Time { return now }
+	rec.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	now = now.Add(time.Hour)
+	rec.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/2", nil))
+
+	// The capture file is kept and uploaded once uploads work again
+	err = rec.upload()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "it is kept at")
+	assert.Equal(t, []string{}, rec.Files())
+	assert.Nil(t, os.Remove(blocker))
+	assert.Nil(t, rec.Close())
+	files := rec.Files()
+	assert.Equal(t, 2, len(files))
+	assert.Contains(t, readCapture(t, files[0]), "GET /users/1 HTTP/1.1\r\n")
+}
@@ -0,0 +1,232 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io"
+	"strings"
+
+	"gopkg.in/Clever/pathio.v3"
+
+	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/science"
+	"github.com/Clever/http-science/summary"
+)
+
+// maxDiffLines is the most lines per body we line-diff, larger bodies are shown without highlighting
+const maxDiffLines = 2000
+
+// Loc returns where the report is written: report_loc if set, otherwise next to the diff log
+func Loc(payload *config.Payload) string {
+	if payload.ReportLoc != "" {
+		return payload.ReportLoc
+	}
+	if payload.DiffLoc != "" {
+		return payload.DiffLoc + ".html"
+	}
+	return ""
+}
+
+// Write renders the report and writes it to loc
+func Write(loc string, s *summary.Summary, diffs []science.Diff) error {
+	var buf bytes.Buffer
+	if err := Render(&buf, s, diffs); err != nil {
+		return err
+	}
+	return pathio.Write(loc, buf.Bytes())
+}
+
+// Render writes a self-contained HTML report of the run with summary tables and a
+// side-by-side view of each sampled diff
+func Render(w io.Writer, s *summary.Summary, diffs []science.Diff) error {
+	views := []diffView{}
+	for _, d := range diffs {
+		views = append(views, newDiffView(d))
+	}
+	return page.Execute(w, struct {
+		Summary *summary.Summary
+		Diffs   []diffView
+	}{s, views})
+}
+
+// line is a line of a response, marked if it differs from the other side
+type line struct {
+	Text    string
+	Changed bool
+}
+
+type diffView struct {
+	science.Diff
+	ControlLines    []line
+	ExperimentLines []line
+}
+
+func newDiffView(d science.Diff) diffView {
+	changedHeaders := map[string]bool{}
+	for _, f := range d.Fields {
+		if f == "code" {
+			changedHeaders[statusLine] = true
+		} else if strings.HasPrefix(f, "header.") {
+			changedHeaders[strings.ToLower(strings.TrimPrefix(f, "header."))] = true
+		}
+	}
+	controlHead, controlBody := splitDump(d.Control)
+	expHead, expBody := splitDump(d.Experiment)
+	controlBodyLines, expBodyLines := diffLines(controlBody, expBody)
+	return diffView{
+		Diff:            d,
+		ControlLines:    append(headLines(controlHead, changedHeaders), controlBodyLines...),
+		ExperimentLines: append(headLines(expHead, changedHeaders), expBodyLines...),
+	}
+}
+
+// splitDump splits a response dump into its status line and headers, and its body
+func splitDump(dump string) ([]string, []string) {
+	parts := strings.SplitN(dump, "\r\n\r\n", 2)
+	head := strings.Split(strings.TrimRight(parts[0], "\r\n"), "\r\n")
+	if len(parts) == 1 {
+		return head, []string{}
+	}
+	return head, strings.Split(prettyJSON(parts[1]), "\n")
+}
+
+// prettyJSON indents the body if it is JSON so it diffs line by line
+func prettyJSON(body string) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(body), "", "  "); err != nil {
+		return body
+	}
+	return buf.String()
+}
+
+// statusLine is the key headLines looks the status line up under
+const statusLine = ":status"
+
+// headLines marks the status line and headers that differ
+func headLines(head []string, changedHeaders map[string]bool) []line {
+	lines := []line{}
+	for i, h := range head {
+		name := strings.ToLower(strings.SplitN(h, ":", 2)[0])
+		if i == 0 {
+			name = statusLine
+		}
+		lines = append(lines, line{Text: h, Changed: changedHeaders[name]})
+	}
+	lines = append(lines, line{})
+	return lines
+}
+
+// diffLines marks the lines of a and b that aren't in their longest common subsequence
+func diffLines(a, b []string) ([]line, []line) {
+	la, lb := make([]line, len(a)), make([]line, len(b))
+	for i := range a {
+		la[i] = line{Text: a[i], Changed: true}
+	}
+	for i := range b {
+		lb[i] = line{Text: b[i], Changed: true}
+	}
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		return la, lb
+	}
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		if a[i] == b[j] {
+			la[i].Changed, lb[j].Changed = false, false
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			i++
+		} else {
+			j++
+		}
+	}
+	return la, lb
+}
+
+var funcs = template.FuncMap{
+	"pct": func(rate float64) float64 { return 100 * rate },
+}
+
+var page = template.Must(template.New("report").Funcs(funcs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>http-science {{.Summary.Payload.JobType}} report: {{.Summary.Payload.ServiceName}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+th { background: #eee; }
+details { margin-bottom: 1em; border: 1px solid #ccc; padding: 4px; }
+summary { cursor: pointer; font-family: monospace; }
+.side { display: flex; gap: 1em; }
+.side > div { flex: 1; min-width: 0; }
+pre { background: #f8f8f8; padding: 4px; overflow-x: auto; margin: 0; }
+.changed { background: #fdd; display: block; }
+.partial { color: #c00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>http-science {{.Summary.Payload.JobType}} report: {{.Summary.Payload.ServiceName}}</h1>
+{{if .Summary.Partial}}<p class="partial">The run was interrupted, results are partial</p>{{end}}
+{{if .Summary.DryRun}}<p class="partial">Dry run: {{.Summary.DryRunWrites}} writes were only sent to {{if .Summary.Payload.DryRunURL}}{{.Summary.Payload.DryRunURL}}{{else}}the experiment{{end}} and not compared</p>{{end}}
+<table>
+<tr><th>Control</th><td>{{.Summary.Payload.ControlURL}}</td></tr>
+<tr><th>Experiment</th><td>{{.Summary.Payload.ExperimentURL}}</td></tr>
+<tr><th>Started</th><td>{{.Summary.StartTime}}</td></tr>
+<tr><th>Ended</th><td>{{.Summary.EndTime}} ({{.Summary.ExitReason}})</td></tr>
+<tr><th>Requests</th><td>{{.Summary.Reqs}}</td></tr>
+<tr><th>Diffs</th><td>{{.Summary.Diffs}}</td></tr>
+</table>
+
+<h2>Routes</h2>
+<table>
+<tr><th>Route</th><th>Requests</th><th>Diffs</th><th>Diff rate</th><th>Errors</th><th>Error rate</th><th>p99 ms</th><th>Control p99 ms</th></tr>
+{{range .Summary.Routes}}<tr><td>{{.Route}}</td><td>{{.Reqs}}</td><td>{{.Diffs}}</td><td>{{printf "%.2f%%" (pct .DiffRate)}}</td><td>{{.Errors}}</td><td>{{printf "%.2f%%" (pct .ErrorRate)}}</td><td>{{printf "%.1f" .Latency.P99Ms}}</td><td>{{printf "%.1f" .ControlLatency.P99Ms}}</td></tr>
+{{end}}</table>
+
+<h2>Route coverage</h2>
+<p>Routes replayed: {{len .Summary.Coverage.Covered}}. Routes in the capture but skipped: {{len .Summary.Coverage.Skipped}}</p>
+{{if .Summary.Coverage.Skipped}}<table>
+<tr><th>Skipped route</th><th>Seen</th></tr>
+{{range .Summary.Coverage.Skipped}}<tr><td>{{.Route}}</td><td>{{.Seen}}</td></tr>
+{{end}}</table>{{end}}
+
+<h2>Status codes of diffs</h2>
+<table>
+<tr><th>Control</th><th>Experiment</th><th>Diffs</th></tr>
+{{range .Summary.DiffCodes}}<tr><td>{{.Control}}</td><td>{{.Experiment}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+
+<h2>Sampled diffs</h2>
+{{range .Diffs}}<details>
+<summary>{{.Route}} {{.ControlCode}} &rarr; {{.ExperimentCode}}: {{range $i, $f := .Fields}}{{if $i}}, {{end}}{{$f}}{{end}}</summary>
+<h4>Request</h4>
+<pre>{{.Request}}</pre>
+<div class="side">
+<div><h4>Control</h4><pre>{{range .ControlLines}}<span{{if .Changed}} class="changed"{{end}}>{{.Text}}
+</span>{{end}}</pre></div>
+<div><h4>Experiment</h4><pre>{{range .ExperimentLines}}<span{{if .Changed}} class="changed"{{end}}>{{.Text}}
+</span>{{end}}</pre></div>
+</div>
+</details>
+{{end}}
+</body>
+</html>
+`))
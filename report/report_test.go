@@ -0,0 +1,67 @@
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/science"
+	"github.com/Clever/http-science/summary"
+)
+
+func TestDiffLines(t *testing.T) {
+	a, b := diffLines([]string{"{", `"a": 1,`, `"b": 2`, "}"}, []string{"{", `"a": 1,`, `"b": 3`, "}"})
+	assert.Equal(t, []line{{"{", false}, {`"a": 1,`, false}, {`"b": 2`, true}, {"}", false}}, a)
+	assert.Equal(t, []line{{"{", false}, {`"a": 1,`, false}, {`"b": 3`, true}, {"}", false}}, b)
+}
+
+func TestNewDiffView(t *testing.T) {
+	v := newDiffView(science.Diff{
+		Fields:     []string{"code", "header.X-Version", "body.b"},
+		Control:    "HTTP/1.1 200 OK\r\nX-Version: 1\r\nContent-Type: application/json\r\n\r\n{\"a\": 1, \"b\": 2}",
+		Experiment: "HTTP/1.1 500 Internal Server Error\r\nX-Version: 2\r\nContent-Type: application/json\r\n\r\n{\"a\": 1, \"b\": 3}",
+	})
+	assert.Equal(t, []line{
+		{"HTTP/1.1 200 OK", true},
+		{"X-Version: 1", true},
+		{"Content-Type: application/json", false},
+		{"", false},
+		{"{", false},
+		{`  "a": 1,`, false},
+		{`  "b": 2`, true},
+		{"}", false},
+	}, v.ControlLines)
+}
+
+func TestRender(t *testing.T) {
+	s := &summary.Summary{
+		Payload:      &config.Payload{JobType: "correctness", ServiceName: "my-service"},
+		Partial:      true,
+		DryRun:       true,
+		DryRunWrites: 3,
+		Routes:       []summary.Route{{Route: "GET /v1/users/:id", Reqs: 10, Diffs: 1, DiffRate: 0.1}},
+		Coverage: summary.Coverage{
+			Covered: []string{"GET /v1/users/:id"},
+			Skipped: []summary.SkippedRoute{{Route: "GET /v1/schools", Seen: 2}},
+		},
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, Render(&buf, s, []science.Diff{{
+		Route:      "GET /v1/users/:id",
+		Fields:     []string{"body"},
+		Request:    "GET /v1/users/1 HTTP/1.1\r\n\r\n",
+		Control:    "HTTP/1.1 200 OK\r\n\r\n<b>control</b>",
+		Experiment: "HTTP/1.1 200 OK\r\n\r\nexperiment",
+	}}))
+	html := buf.String()
+	assert.True(t, strings.Contains(html, "results are partial"))
+	assert.True(t, strings.Contains(html, "Dry run: 3 writes were only sent to the experiment and not compared"))
+	assert.True(t, strings.Contains(html, "<td>GET /v1/users/:id</td><td>10</td><td>1</td><td>10.00%</td>"))
+	assert.True(t, strings.Contains(html, "Routes replayed: 1. Routes in the capture but skipped: 1"))
+	assert.True(t, strings.Contains(html, "<tr><td>GET /v1/schools</td><td>2</td></tr>"))
+	// Responses are escaped
+	assert.True(t, strings.Contains(html, `<span class="changed">&lt;b&gt;control&lt;/b&gt;`))
+}
@@ -6,20 +6,58 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"strings"
 	"sync"
+
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+
+	"github.com/Clever/http-science/config"
 )
 
 // Results records results from science
 type Results struct {
 	Reqs int
-	// Only used for correctness tests
-	Codes   map[int]map[int]int
-	Mutex   *sync.Mutex
-	Diffs   int
-	DiffLog io.ReadWriter
+	// MaxReqs is the number of requests to forward. Requests past it are dropped. Ignored if value <= 0
+	MaxReqs int `json:"-"`
+	// pending counts the requests reserved towards MaxReqs that haven't been counted in Reqs yet
+	pending int
+	// reached is closed once Reqs reaches MaxReqs
+	reached chan struct{}
+	// Received counts every request gor sent us, including ones that weren't forwarded,
+	// but not ones skipped when resuming
+	Received int
+	// Skip is the number of requests to drop because they were replayed before resuming from a checkpoint
+	Skip int `json:"-"`
+	// Errors counts failed forwards and server errors by target, e.g. "experiment_5xx"
+	Errors map[string]int
+	// Only used for correctness tests. Codes counts the status code pairs of diffs, AllCodes of every request
+	Codes    map[int]map[int]int
+	AllCodes map[int]map[int]int
+	Mutex    *sync.Mutex `json:"-"`
+	Diffs    int
+	DiffLog  io.Writer `json:"-"`
+	// Noise counts, per field, how often the two controls disagreed
+	Noise map[string]int
+	// FieldDiffs counts, per endpoint, how often each field differed with the experiment
+	FieldDiffs map[string]*FieldStats
+	// Routes records results per normalized route, e.g. "GET /v1/users/:id"
+	Routes map[string]*RouteStats
+	// Samples holds the diffs kept per route and status code pair when config.DiffSampleSize is set. They are
+	// only written to the diff log at the end, so they are saved with the checkpoint to survive a restart
+	Samples map[string]*DiffSample
+	// DroppedDiffs counts the diffs that didn't make it into the sample
+	DroppedDiffs int
+	// DryRunWrites counts the writes that were only sent to the experiment or dry run URL, without comparing them
+	DryRunWrites int
+	// Filtered counts the requests the filter didn't forward
+	Filtered int
+	// Unselected counts the requests the selector didn't forward, as duplicates or past their route's limit
+	Unselected int
+	// SeenRoutes counts the requests to each normalized route gor sent us, forwarded or not
+	SeenRoutes map[string]int
 }
 
 type forwardedRequest struct {
@@ -36,9 +74,7 @@ var Res Results
 // It lets you pass a slice of headers that you want removed to make it easier to compare
 // to other responses.
 func forwardRequest(r *http.Request, addr string, cleanup []string) (*forwardedRequest, error) {
-
-	addr = strings.TrimPrefix(addr, "https://")
-	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true}) // TODO - get tests to work without this
+	conn, err := dial(addr)
 	if err != nil {
 		return &forwardedRequest{}, fmt.Errorf("error establishing tcp connection to %s: %s", addr, err)
 	}
@@ -71,3 +107,47 @@ func forwardRequest(r *http.Request, addr string, cleanup []string) (*forwardedR
 		header: res.Header,
 	}, nil
 }
+
+// filter returns true if the request should be forwarded, counting it if not
+func (r *Results) filter(f *Filter, req *http.Request) bool {
+	allowed, err := f.Allow(req)
+	if err != nil {
+		config.KV.ErrorD("filtering-request-failed", logger.M{"err": err.Error()})
+	}
+	if !allowed {
+		r.Mutex.Lock()
+		defer r.Mutex.Unlock()
+		r.Filtered++
+	}
+	return allowed
+}
+
+// skipReplayed returns true if the request was already replayed before resuming from a checkpoint
+func (r *Results) skipReplayed() bool {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if r.Skip > 0 {
+		r.Skip--
+		return true
+	}
+	r.Received++
+	return false
+}
+
+// dial connects to addr, which is host:port optionally prefixed with https:// or http://.
+// TLS is used unless the scheme is http, and the port defaults to the scheme's
+func dial(addr string) (net.Conn, error) {
+	useTLS, port := true, "443"
+	if strings.HasPrefix(addr, "http://") {
+		useTLS, port = false, "80"
+	}
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "https://"), "http://")
+	addr = strings.SplitN(addr, "/", 2)[0]
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, port)
+	}
+	if !useTLS {
+		return net.Dial("tcp", addr)
+	}
+	return tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true}) // TODO - get tests to work without this
+}
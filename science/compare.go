@@ -1,13 +1,45 @@
 package science
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"reflect"
+	"sort"
 
 	"github.com/Clever/http-science/config"
 )
 
+// Comparator decides which fields of a control and experiment response differ
+type Comparator struct {
+	// WeakCompare allows arrays in JSON bodies to be out of order
+	WeakCompare bool
+	// IgnoredHeaders are removed from responses before comparing, along with defaultIgnoredHeaders
+	IgnoredHeaders []string
+	// IgnoredBodyPaths are the JSON body paths we ignore diffs on, e.g. "users[].updated_at"
+	IgnoredBodyPaths []string
+	// RouteRules are comparison rules for specific routes
+	RouteRules []config.RouteRule
+}
+
+// configComparator returns the comparator set up from the payload by validate
+func configComparator() Comparator {
+	return Comparator{
+		WeakCompare:      config.WeakCompare,
+		IgnoredHeaders:   config.IgnoredHeaders,
+		IgnoredBodyPaths: config.IgnoredBodyPaths,
+		RouteRules:       config.RouteRules,
+	}
+}
+
+// ignoredHeaders returns every header removed from responses before comparing
+func (c Comparator) ignoredHeaders() []string {
+	return append(append([]string{}, defaultIgnoredHeaders...), c.IgnoredHeaders...)
+}
+
 // cleanupHeaders removes headers that can be different for inconsequential reasons
 func cleanupHeaders(res *http.Response, cleanup []string) {
 	for _, val := range cleanup {
@@ -28,11 +60,11 @@ func headersAreEqual(control, experiment http.Header) bool {
 	return reflect.DeepEqual(control, experiment)
 }
 
-func bodiesAreEqual(control, experiment []byte) bool {
+func (c Comparator) bodiesAreEqual(control, experiment []byte) bool {
 	if isSimplyEqual(control, experiment) {
 		return true
 	}
-	return isJSONEqual(control, experiment)
+	return c.isJSONEqual(control, experiment)
 }
 
 // isSimplyEqual returns true if the two strings are equal, false otherwise
@@ -43,7 +75,7 @@ func isSimplyEqual(dumpControl, dumpExperiment []byte) bool {
 // isJSONEqual compares two responses and returns true if they are equivalent
 // it ignores ordering of keys and elements in maps and arrays in the body
 // it will be fairly inefficient for large objects (n^2 on arrays)
-func isJSONEqual(resControl, resExperiment []byte) bool {
+func (c Comparator) isJSONEqual(resControl, resExperiment []byte) bool {
 	var controlJSON, expJSON map[string]interface{}
 	// Return false if they can't be parsed as JSON
 	if err := json.Unmarshal(resControl, &controlJSON); err != nil {
@@ -53,7 +85,7 @@ func isJSONEqual(resControl, resExperiment []byte) bool {
 		return false
 	}
 
-	if config.WeakCompare {
+	if c.WeakCompare {
 		return msiAreEqual(controlJSON, expJSON)
 	}
 	return reflect.DeepEqual(controlJSON, expJSON)
@@ -146,3 +178,167 @@ func inList(v int, list []int) bool {
 	}
 	return false
 }
+
+// diffFields returns the name of every field that differs between the two responses.
+// Fields are named "code", "header.<Name>", "body.<json path>" for JSON bodies where array
+// elements are collapsed to "[]", or just "body" when the bodies can't be compared as JSON.
+func (c Comparator) diffFields(control, experiment *forwardedRequest) []string {
+	fields := []string{}
+	if !codesAreEqual(control.code, experiment.code) {
+		fields = append(fields, "code")
+	}
+	fields = append(fields, headerDiffs(control.header, experiment.header)...)
+	return append(fields, c.bodyDiffs(control.body, experiment.body)...)
+}
+
+// headerDiffs returns the fields of the headers that differ between control and experiment
+func headerDiffs(control, experiment http.Header) []string {
+	diffs := []string{}
+	for k, v := range control {
+		if !reflect.DeepEqual(v, experiment[k]) {
+			diffs = append(diffs, "header."+k)
+		}
+	}
+	for k := range experiment {
+		if _, ok := control[k]; !ok {
+			diffs = append(diffs, "header."+k)
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// bodyDiffs returns the fields of the bodies that differ between control and experiment
+func (c Comparator) bodyDiffs(control, experiment []byte) []string {
+	if c.bodiesAreEqual(control, experiment) {
+		return []string{}
+	}
+	var controlJSON, expJSON map[string]interface{}
+	if json.Unmarshal(control, &controlJSON) != nil || json.Unmarshal(experiment, &expJSON) != nil {
+		return []string{"body"}
+	}
+	diffs := c.jsonDiffPaths(controlJSON, expJSON, "body")
+	if len(diffs) == 0 {
+		return []string{"body"}
+	}
+	return diffs
+}
+
+// jsonDiffPaths walks two decoded JSON values and returns the deduplicated, sorted paths that differ
+func (c Comparator) jsonDiffPaths(a, b interface{}, path string) []string {
+	seen := map[string]bool{}
+	c.addJSONDiffPaths(a, b, path, seen)
+	diffs := []string{}
+	for p := range seen {
+		diffs = append(diffs, p)
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+func (c Comparator) addJSONDiffPaths(a, b interface{}, path string, seen map[string]bool) {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		bm, ok := b.(map[string]interface{})
+		if !ok {
+			seen[path] = true
+			return
+		}
+		for k, v := range a {
+			bv, ok := bm[k]
+			if !ok {
+				seen[path+"."+k] = true
+				continue
+			}
+			c.addJSONDiffPaths(v, bv, path+"."+k, seen)
+		}
+		for k := range bm {
+			if _, ok := a[k]; !ok {
+				seen[path+"."+k] = true
+			}
+		}
+	case []interface{}:
+		bs, ok := b.([]interface{})
+		if !ok || len(a) != len(bs) {
+			seen[path] = true
+			return
+		}
+		if c.WeakCompare && sliceAreEqual(a, bs) {
+			return
+		}
+		for i := range a {
+			c.addJSONDiffPaths(a[i], bs[i], path+"[]", seen)
+		}
+	default:
+		if !reflect.DeepEqual(a, b) {
+			seen[path] = true
+		}
+	}
+}
+
+// withoutFields returns the fields in diffs that are not in ignored or ignored by the comparator for the route
+func (c Comparator) withoutFields(diffs []string, ignored map[string]bool, route string) []string {
+	kept := []string{}
+	for _, d := range diffs {
+		if !ignored[d] && !c.isIgnoredField(d, route) {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+// DiffResponses parses two raw HTTP responses, e.g. from the diff log, and returns the fields
+// that differ after removing the headers we ignore
+func (c Comparator) DiffResponses(control, experiment []byte) ([]string, error) {
+	ignored := c.ignoredHeaders()
+	controlRes, err := readDump(control, ignored)
+	if err != nil {
+		return nil, fmt.Errorf("error reading control response: %s", err)
+	}
+	experimentRes, err := readDump(experiment, ignored)
+	if err != nil {
+		return nil, fmt.Errorf("error reading experiment response: %s", err)
+	}
+	return c.withoutFields(c.diffFields(controlRes, experimentRes), map[string]bool{}, ""), nil
+}
+
+// Diff returns the fields that differ between the control and experiment responses to the request
+// after removing the headers and fields we ignore. It reads and closes both bodies
+func (c Comparator) Diff(r *http.Request, control, experiment *http.Response) ([]string, error) {
+	ignored := c.ignoredHeaders()
+	controlRes, err := readResponse(control, ignored)
+	if err != nil {
+		return nil, fmt.Errorf("error reading control response: %s", err)
+	}
+	experimentRes, err := readResponse(experiment, ignored)
+	if err != nil {
+		return nil, fmt.Errorf("error reading experiment response: %s", err)
+	}
+	route := endpoint(r.Method, r.URL.Path)
+	return c.withoutFields(c.diffFields(controlRes, experimentRes), map[string]bool{}, route), nil
+}
+
+// readDump parses a raw HTTP response
+func readDump(dump []byte, cleanup []string) (*forwardedRequest, error) {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(dump)), nil)
+	if err != nil {
+		return nil, err
+	}
+	forwarded, err := readResponse(res, cleanup)
+	if err != nil {
+		return nil, err
+	}
+	forwarded.dump = string(dump)
+	return forwarded, nil
+}
+
+// readResponse reads the response into what we compare, without the dump
+func readResponse(res *http.Response, cleanup []string) (*forwardedRequest, error) {
+	defer res.Body.Close()
+	cleanupHeaders(res, cleanup)
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &forwardedRequest{body: body, code: res.StatusCode, header: res.Header}, nil
+}
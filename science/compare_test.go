@@ -1,9 +1,9 @@
 package science
 
 import (
+	"net/http"
 	"testing"
 
-	"github.com/Clever/http-science/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,44 +18,64 @@ func TestSimpleDiffs(t *testing.T) {
 func TestJSONDiffs(t *testing.T) {
 
 	for _, v := range []bool{true, false} {
-		config.WeakCompare = v
+		c := Comparator{WeakCompare: v}
 		// Not equal when one or both are not json
 		not := []byte("not json")
 		jsonSimple2 := []byte(`{"yo": "jt"}`)
 		jsonSimple1 := []byte(`{"yo": "jo"}`)
-		assert.Equal(t, false, isJSONEqual(jsonSimple1, not))
-		assert.Equal(t, false, isJSONEqual(not, not))
+		assert.Equal(t, false, c.isJSONEqual(jsonSimple1, not))
+		assert.Equal(t, false, c.isJSONEqual(not, not))
 
 		// Correctly handles simple json
-		assert.Equal(t, true, isJSONEqual(jsonSimple1, jsonSimple1))
-		assert.Equal(t, false, isJSONEqual(jsonSimple1, jsonSimple2))
+		assert.Equal(t, true, c.isJSONEqual(jsonSimple1, jsonSimple1))
+		assert.Equal(t, false, c.isJSONEqual(jsonSimple1, jsonSimple2))
 
 		// Correctly handles out of order keys
 		jsonUnorderedKeys1 := []byte(`{"Hel": "lo", "Wor": "ld"}`)
 		jsonUnorderedKeys2 := []byte(`{"Wor": "ld", "Hel": "lo"}`)
-		assert.Equal(t, true, isJSONEqual(jsonUnorderedKeys1, jsonUnorderedKeys2))
+		assert.Equal(t, true, c.isJSONEqual(jsonUnorderedKeys1, jsonUnorderedKeys2))
 
 		// Correctly handles nested objects
 		jsonNested1 := []byte(`{"Hel": {"lo": ["Wor", "ld"]}}`)
 		jsonNested2 := []byte(`{"Hel": {"lo": ["Wor", "ld!"]}}`)
-		assert.Equal(t, true, isJSONEqual(jsonNested1, jsonNested1))
-		assert.Equal(t, false, isJSONEqual(jsonNested1, jsonNested2))
+		assert.Equal(t, true, c.isJSONEqual(jsonNested1, jsonNested1))
+		assert.Equal(t, false, c.isJSONEqual(jsonNested1, jsonNested2))
 
 		// We correctly handle duplicates in arrays
 		jsonArrayDup1 := []byte(`{"Hello": ["Wor", "ld!", "ld!"]}}`)
 		jsonArrayDup2 := []byte(`{"Hello": ["Wor", "Wor", "ld!"]}}`)
-		assert.Equal(t, false, isJSONEqual(jsonArrayDup1, jsonArrayDup2))
+		assert.Equal(t, false, c.isJSONEqual(jsonArrayDup1, jsonArrayDup2))
 
 		// Stress test
-		assert.Equal(t, false, isJSONEqual(jsonComplicated, jsonComplicatedDifferent))
-		assert.Equal(t, true, isJSONEqual(jsonComplicated, jsonComplicatedUnorderedKey))
+		assert.Equal(t, false, c.isJSONEqual(jsonComplicated, jsonComplicatedDifferent))
+		assert.Equal(t, true, c.isJSONEqual(jsonComplicated, jsonComplicatedUnorderedKey))
 
 		// OOO arrays and are different with weak vs strong comparison
-		assert.Equal(t, v, isJSONEqual(jsonComplicated, jsonComplicatedUnorderedArray))
+		assert.Equal(t, v, c.isJSONEqual(jsonComplicated, jsonComplicatedUnorderedArray))
 	}
 
 }
 
+func TestBodyDiffs(t *testing.T) {
+	c := Comparator{}
+	assert.Equal(t, []string{}, c.bodyDiffs([]byte(`{"a": 1}`), []byte(`{"a": 1}`)))
+	assert.Equal(t, []string{"body"}, c.bodyDiffs([]byte("not json"), []byte("other")))
+	assert.Equal(t, []string{"body.a", "body.b"}, c.bodyDiffs([]byte(`{"a": 1, "b": 2}`), []byte(`{"a": 2}`)))
+	assert.Equal(t, []string{"body.batters.batter[].id", "body.batters.batter[].type"},
+		c.bodyDiffs(jsonComplicated, jsonComplicatedUnorderedArray)[:2])
+	assert.Equal(t, []string{"body.topping[].type"}, c.bodyDiffs(jsonComplicated, jsonComplicatedDifferent))
+
+	c.WeakCompare = true
+	assert.Equal(t, []string{}, c.bodyDiffs(jsonComplicated, jsonComplicatedUnorderedArray))
+}
+
+func TestHeaderDiffs(t *testing.T) {
+	control := http.Header{"A": {"1"}, "B": {"2"}}
+	experiment := http.Header{"A": {"1"}, "B": {"3"}, "C": {"4"}}
+	assert.Equal(t, []string{"header.B", "header.C"}, headerDiffs(control, experiment))
+	assert.Equal(t, []string{}, headerDiffs(control, control))
+}
+
 var jsonComplicated = []byte(`
 {
     "id": "0001",
@@ -3,23 +3,39 @@ package science
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"net/http/httputil"
 
 	"github.com/Clever/http-science/config"
 	"gopkg.in/Clever/kayvee-go.v3/logger"
 )
 
-// CorrectnessTest is the interface to run correctness tests with
+// CorrectnessTest is the interface to run correctness tests with. It records into Res using the
+// comparison options validate set in config, use NewExperiment for a test with its own results
 type CorrectnessTest struct {
 	ControlURL    string
 	ExperimentURL string
+	// Control2URL is optional. When set, fields that differ between the two controls are
+	// treated as noise and not counted as diffs with the experiment
+	Control2URL string
+	// ControlRewriter and ExperimentRewriter change requests before they are forwarded, either can be nil
+	ControlRewriter    *Rewriter
+	ExperimentRewriter *Rewriter
+	// ControlAuth and ExperimentAuth add credentials to requests after they are rewritten, either can be nil
+	ControlAuth    Authorizer
+	ExperimentAuth Authorizer
+	// Redactor removes sensitive data from diffs before they are recorded, it can be nil
+	Redactor *Redactor
+	// DryRun sends writes only to DryRunURL, or the experiment if it is empty, without comparing them
+	DryRun    bool
+	DryRunURL string
+	// Filter decides which requests are forwarded, then Selector picks from them. Either can be nil
+	Filter   *Filter
+	Selector *Selector
 }
 
 var errorForwardingControl = []byte("Error forwarding request Control")
+var errorForwardingControl2 = []byte("Error forwarding request Control2")
 var errorForwardingExperiment = []byte("Error forwarding request Experiment")
 
 // These headers can differ in inconsequential ways so we remove them from the response before comparing
@@ -29,92 +45,80 @@ var defaultIgnoredHeaders = []string{
 	"Ot-Tracer-Sampled", "Ot-Tracer-Spanid", "Ot-Tracer-Traceid",
 }
 
-func incrementConcurrency() {
-	config.Concurrency.Mutex.Lock()
-	defer config.Concurrency.Mutex.Unlock()
-	if config.Concurrency.Value != -1 {
-		config.Concurrency.Value++
-	}
+func (c CorrectnessTest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.experiment().ServeHTTP(w, r)
 }
 
-func decrementConcurrency() bool {
-	config.Concurrency.Mutex.Lock()
-	defer config.Concurrency.Mutex.Unlock()
-	if config.Concurrency.Value == 0 {
-		return false
-	} else if config.Concurrency.Value > 0 {
-		config.Concurrency.Value--
+// experiment returns the Experiment that records into Res using the options validate set in config
+func (c CorrectnessTest) experiment() *Experiment {
+	return &Experiment{
+		opts: Options{
+			ControlURL:         c.ControlURL,
+			ExperimentURL:      c.ExperimentURL,
+			Control2URL:        c.Control2URL,
+			Comparator:         configComparator(),
+			ControlRewriter:    c.ControlRewriter,
+			ExperimentRewriter: c.ExperimentRewriter,
+			ControlAuth:        c.ControlAuth,
+			ExperimentAuth:     c.ExperimentAuth,
+			Redactor:           c.Redactor,
+			DryRun:             c.DryRun,
+			DryRunURL:          c.DryRunURL,
+			Filter:             c.Filter,
+			Selector:           c.Selector,
+			DiffSampleSize:     config.DiffSampleSize,
+		},
+		Results:     &Res,
+		concurrency: (*concurrency)(&config.Concurrency),
+		inFlight:    inFlight,
 	}
-	return true
 }
 
-func (c CorrectnessTest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Bail if too many concurrent requests, else update concurrency if we are using it
-	if !decrementConcurrency() {
-		w.WriteHeader(200)
-		return
-	}
-	defer incrementConcurrency()
-
-	// save request for potential diff logging
-	reqDump, err := httputil.DumpRequest(r, true)
-	if err != nil {
-		log.Printf("error dumping request: %s", err)
-	}
-
-	// Body can only be read once so we need to duplicate it
-	rControl, rExperiment, err := duplicateRequest(r)
+// duplicateRequest returns n copies of the request, each with its own copy of the body, header and URL
+func duplicateRequest(r *http.Request, n int) ([]*http.Request, error) {
+	r.Header.Del("If-None-Match")
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		config.KV.ErrorD("duplicating-request-failed", logger.M{"err": err.Error()})
-		return
+		return nil, err
 	}
+	defer r.Body.Close()
 
-	ignoredHeaders := append(defaultIgnoredHeaders, config.IgnoredHeaders...)
-	control, err := forwardRequest(rControl, c.ControlURL, ignoredHeaders)
-	handleForwardErr(control, "control", err)
-	experiment, err := forwardRequest(rExperiment, c.ExperimentURL, ignoredHeaders)
-	handleForwardErr(experiment, "experiment", err)
-
-	hasDiff := !codesAreEqual(control.code, experiment.code) || !headersAreEqual(control.header, experiment.header) || !bodiesAreEqual(control.body, experiment.body)
-
-	Res.Mutex.Lock()
-	defer Res.Mutex.Unlock()
-	Res.Reqs++
-
-	if hasDiff {
-		updateCodes(control.code, experiment.code)
-		Res.Diffs++
-		Res.DiffLog.Write(
-			[]byte(fmt.Sprintf("=== diff ===\n%s\n---\n%s\n---\n%s\n============\n", string(reqDump), control.dump, experiment.dump)),
-		)
+	reqs := make([]*http.Request, n)
+	for i := range reqs {
+		dup := *r
+		dup.Body = ioutil.NopCloser(bytes.NewReader(body))
+		dup.Header = r.Header.Clone()
+		u := *r.URL
+		dup.URL = &u
+		reqs[i] = &dup
 	}
+	return reqs, nil
 }
 
-func duplicateRequest(r *http.Request) (*http.Request, *http.Request, error) {
-	r.Header.Del("If-None-Match")
-	b1, b2 := new(bytes.Buffer), new(bytes.Buffer)
-	w := io.MultiWriter(b1, b2)
-	_, err := io.Copy(w, r.Body)
-	if err != nil {
-		return nil, nil, err
+// addCode counts the status code pair in codes, which is keyed by the experiment code then the control code
+func addCode(codes map[int]map[int]int, codeControl, codeExperiment int) {
+	if _, ok := codes[codeExperiment][codeControl]; !ok {
+		if _, ok := codes[codeExperiment]; !ok {
+			codes[codeExperiment] = map[int]int{}
+		}
+		codes[codeExperiment][codeControl] = 0
 	}
-	defer r.Body.Close()
-
-	r1, r2 := *r, *r
-	r1.Body = ioutil.NopCloser(b1)
-	r2.Body = ioutil.NopCloser(b2)
-
-	return &r1, &r2, err
+	codes[codeExperiment][codeControl]++
 }
 
-func updateCodes(codeControl, codeExperiment int) {
-	if _, ok := Res.Codes[codeExperiment][codeControl]; !ok {
-		if _, ok := Res.Codes[codeExperiment]; !ok {
-			Res.Codes[codeExperiment] = map[int]int{}
-		}
-		Res.Codes[codeExperiment][codeControl] = 0
+// updateErrors counts failed forwards and server errors from which target. r.Mutex must be held
+func (r *Results) updateErrors(which string, code int) {
+	if !isErrorCode(code) {
+		return
+	}
+	if r.Errors == nil {
+		r.Errors = map[string]int{}
+	}
+	if code == -1 {
+		r.Errors[which+"_forward_failed"]++
+	} else {
+		r.Errors[which+"_5xx"]++
 	}
-	Res.Codes[codeExperiment][codeControl]++
 }
 
 func handleForwardErr(res *forwardedRequest, which string, err error) {
@@ -124,9 +128,17 @@ func handleForwardErr(res *forwardedRequest, which string, err error) {
 		if which == "control" {
 			res.body = errorForwardingControl
 			res.dump = string(errorForwardingControl)
+		} else if which == "control2" {
+			res.body = errorForwardingControl2
+			res.dump = string(errorForwardingControl2)
 		} else {
 			res.body = errorForwardingExperiment
 			res.dump = string(errorForwardingExperiment)
 		}
 	}
 }
+
+// isErrorCode returns true if the code is from a failed forward or a server error
+func isErrorCode(code int) bool {
+	return code == -1 || code >= 500
+}
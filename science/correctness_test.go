@@ -21,11 +21,12 @@ func refreshResults() Results {
 		Mutex:   &sync.Mutex{},
 		Diffs:   0,
 		DiffLog: bytes.NewBuffer(b),
+		Noise:   map[string]int{},
 	}
 }
 
 func compareDiffLog(t *testing.T, scienceServer *httptest.Server, controlResp, expResp string) {
-	diff, err := ioutil.ReadAll(Res.DiffLog)
+	diff, err := ioutil.ReadAll(Res.DiffLog.(*bytes.Buffer))
 	assert.Nil(t, err)
 	split := strings.Split(scienceServer.URL, ":")
 	port := split[len(split)-1]
@@ -125,3 +126,65 @@ func TestCorrectness(t *testing.T) {
 	assert.Equal(t, 1, Res.Reqs)
 	assert.Equal(t, 0, Res.Diffs)
 }
+
+func TestCorrectnessControl2(t *testing.T) {
+	calls := 0
+	noisyHandler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			fmt.Fprintf(w, `{"id": "abc", "ts": %d}`, calls)
+		},
+	)
+	noisyServer := httptest.NewTLSServer(noisyHandler)
+	defer noisyServer.Close()
+	diffHandler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"id": "xyz", "ts": 0}`)
+		},
+	)
+	diffServer := httptest.NewTLSServer(diffHandler)
+	defer diffServer.Close()
+
+	// Fields that differ between the controls are noise - no diff
+	scienceServer := httptest.NewServer(CorrectnessTest{
+		ControlURL:    noisyServer.URL,
+		ExperimentURL: noisyServer.URL,
+		Control2URL:   noisyServer.URL,
+	})
+	Res = refreshResults()
+
+	_, err := http.Get(scienceServer.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, Res.Reqs)
+	assert.Equal(t, 0, Res.Diffs)
+	assert.Equal(t, map[string]int{"body.ts": 1}, Res.Noise)
+
+	// Fields that don't differ between the controls are still diffs
+	scienceServer = httptest.NewServer(CorrectnessTest{
+		ControlURL:    noisyServer.URL,
+		ExperimentURL: diffServer.URL,
+		Control2URL:   noisyServer.URL,
+	})
+	Res = refreshResults()
+
+	_, err = http.Get(scienceServer.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, Res.Reqs)
+	assert.Equal(t, 1, Res.Diffs)
+	assert.Equal(t, map[string]int{"body.ts": 1}, Res.Noise)
+
+	// A control2 that can't be reached doesn't hide diffs as noise
+	scienceServer = httptest.NewServer(CorrectnessTest{
+		ControlURL:    noisyServer.URL,
+		ExperimentURL: diffServer.URL,
+		Control2URL:   "localhost:not_a_port",
+	})
+	Res = refreshResults()
+
+	_, err = http.Get(scienceServer.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, Res.Reqs)
+	assert.Equal(t, 1, Res.Diffs)
+	assert.Equal(t, map[string]int{}, Res.Noise)
+	assert.Equal(t, 1, Res.Errors["control2_forward_failed"])
+}
@@ -0,0 +1,109 @@
+package science
+
+import (
+	"sync"
+	"time"
+)
+
+// inFlightRequests tracks the requests being forwarded so we can wait for them when shutting down
+type inFlightRequests struct {
+	Mutex    *sync.Mutex
+	Draining bool
+	// Paused holds new requests until resumed, resumed is signaled when it is unset
+	Paused  bool
+	resumed *sync.Cond
+	Count   int
+}
+
+// inFlight tracks the requests forwarded by CorrectnessTest and LoadTest
+var inFlight = newInFlight()
+
+func newInFlight() *inFlightRequests {
+	mutex := &sync.Mutex{}
+	return &inFlightRequests{Mutex: mutex, resumed: sync.NewCond(mutex)}
+}
+
+// Drain stops CorrectnessTest and LoadTest from forwarding any new requests
+func Drain() {
+	inFlight.drain()
+}
+
+// WaitInFlight waits up to timeout for the requests being forwarded by CorrectnessTest and LoadTest
+// to finish. It returns false if some were still in flight at the deadline
+func WaitInFlight(timeout time.Duration) bool {
+	return inFlight.wait(timeout)
+}
+
+// Pause holds new requests to CorrectnessTest and LoadTest and waits up to timeout for the ones in
+// flight to finish, so the results are consistent with the requests received. If they don't finish
+// in time it resumes and returns false. Call Resume once done
+func Pause(timeout time.Duration) bool {
+	return inFlight.pause(timeout)
+}
+
+// Resume lets the requests held by Pause through
+func Resume() {
+	inFlight.resume()
+}
+
+func (f *inFlightRequests) drain() {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	f.Draining = true
+	f.resumed.Broadcast()
+}
+
+func (f *inFlightRequests) pause(timeout time.Duration) bool {
+	f.Mutex.Lock()
+	f.Paused = true
+	f.Mutex.Unlock()
+	if !f.wait(timeout) {
+		f.resume()
+		return false
+	}
+	return true
+}
+
+func (f *inFlightRequests) resume() {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	f.Paused = false
+	f.resumed.Broadcast()
+}
+
+func (f *inFlightRequests) wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		f.Mutex.Lock()
+		count := f.Count
+		f.Mutex.Unlock()
+		if count == 0 {
+			return true
+		} else if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// start records a request as in flight, returning false if we are draining and it shouldn't be forwarded.
+// It waits while paused
+func (f *inFlightRequests) start() bool {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	for f.Paused && !f.Draining {
+		f.resumed.Wait()
+	}
+	if f.Draining {
+		return false
+	}
+	f.Count++
+	return true
+}
+
+// finish records a request as no longer in flight
+func (f *inFlightRequests) finish() {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	f.Count--
+}
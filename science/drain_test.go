@@ -0,0 +1,66 @@
+package science
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrain(t *testing.T) {
+	defer func() { inFlight.Draining = false }()
+	release := make(chan struct{})
+	slowHandler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		},
+	)
+	slowServer := httptest.NewTLSServer(slowHandler)
+	defer slowServer.Close()
+
+	Res = refreshLoadResults()
+	scienceServer := httptest.NewServer(LoadTest{URL: slowServer.URL})
+	defer scienceServer.Close()
+
+	go http.Get(scienceServer.URL)
+	// Wait for the request to be in flight
+	for WaitInFlight(0) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Drain()
+
+	// New requests are rejected while draining
+	res, err := http.Get(scienceServer.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+	// Times out while the request is in flight, then finishes once it is done
+	assert.False(t, WaitInFlight(10*time.Millisecond))
+	close(release)
+	assert.True(t, WaitInFlight(time.Second))
+	assert.Equal(t, 1, Res.Reqs)
+}
+
+func TestPause(t *testing.T) {
+	f := newInFlight()
+	assert.True(t, f.start())
+
+	// Times out while a request is in flight, and lets new requests through again
+	assert.False(t, f.pause(10*time.Millisecond))
+	assert.True(t, f.start())
+	f.finish()
+
+	f.finish()
+	assert.True(t, f.pause(time.Second))
+	started := make(chan bool)
+	go func() { started <- f.start() }()
+	select {
+	case <-started:
+		t.Fatal("request started while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	f.resume()
+	assert.True(t, <-started)
+}
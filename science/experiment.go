@@ -0,0 +1,297 @@
+package science
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/Clever/http-science/config"
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+)
+
+// Options configures an Experiment
+type Options struct {
+	ControlURL    string
+	ExperimentURL string
+	// Control2URL is optional. When set, fields that differ between the two controls are
+	// treated as noise and not counted as diffs with the experiment
+	Control2URL string
+	// Comparator decides which fields of the responses differ
+	Comparator Comparator
+	// ControlRewriter changes requests before they go to the controls, ExperimentRewriter before
+	// they go to the experiment. Either can be nil
+	ControlRewriter    *Rewriter
+	ExperimentRewriter *Rewriter
+	// ControlAuth adds credentials to requests to the controls after they are rewritten, ExperimentAuth
+	// to requests to the experiment. Either can be nil
+	ControlAuth    Authorizer
+	ExperimentAuth Authorizer
+	// Redactor removes sensitive data from diffs before they are recorded. It can be nil
+	Redactor *Redactor
+	// DryRun sends writes, requests whose method isn't in config.SafeMethods, only to DryRunURL or
+	// the experiment if it is empty. They aren't compared
+	DryRun    bool
+	DryRunURL string
+	// Filter decides which requests are forwarded, then Selector picks from them. Either can be nil
+	Filter   *Filter
+	Selector *Selector
+	// DiffSampleSize is the max number of diffs logged per route and status code pair. Ignored if value <= 0
+	DiffSampleSize int
+	// Concurrency is the max number of requests forwarded at once. Ignored if value <= 0
+	Concurrency int
+	// MaxReqs is the number of requests to forward, the rest are dropped. Ignored if value <= 0
+	MaxReqs int
+	// DiffLog is where diffs are written. Diffs are only kept in the results if it is nil
+	DiffLog io.Writer
+}
+
+// Authorizer adds credentials to a request before it is forwarded, see the auth package
+type Authorizer interface {
+	Authorize(r *http.Request) error
+}
+
+// Experiment is a correctness test with its own results, so several can run in one process.
+// It is an http.Handler that forwards each request it gets to the control and experiment
+// and records how their responses differ
+type Experiment struct {
+	opts        Options
+	Results     *Results
+	concurrency *concurrency
+	inFlight    *inFlightRequests
+}
+
+// concurrency is the number of requests that can still be forwarded at once and a mutex. Ignored if value < 0
+type concurrency struct {
+	Value int
+	Mutex *sync.Mutex
+}
+
+// NewExperiment returns an Experiment with empty results
+func NewExperiment(opts Options) *Experiment {
+	diffLog := opts.DiffLog
+	if diffLog == nil {
+		diffLog = ioutil.Discard
+	}
+	limit := opts.Concurrency
+	if limit <= 0 {
+		limit = -1
+	}
+	return &Experiment{
+		opts: opts,
+		Results: &Results{
+			Codes:    map[int]map[int]int{},
+			AllCodes: map[int]map[int]int{},
+			Noise:    map[string]int{},
+			Mutex:    &sync.Mutex{},
+			DiffLog:  diffLog,
+			MaxReqs:  opts.MaxReqs,
+		},
+		concurrency: &concurrency{Value: limit, Mutex: &sync.Mutex{}},
+		inFlight:    newInFlight(),
+	}
+}
+
+// Drain stops the experiment from forwarding any new requests
+func (e *Experiment) Drain() {
+	e.inFlight.drain()
+}
+
+// WaitInFlight waits up to timeout for the requests being forwarded to finish.
+// It returns false if some were still in flight at the deadline
+func (e *Experiment) WaitInFlight(timeout time.Duration) bool {
+	return e.inFlight.wait(timeout)
+}
+
+// FlushSamples writes the sampled diffs to the diff log if Options.DiffSampleSize is set
+func (e *Experiment) FlushSamples() error {
+	return e.Results.FlushSamples(e.opts.DiffSampleSize)
+}
+
+func (e *Experiment) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !e.inFlight.start() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer e.inFlight.finish()
+	if e.Results.reqsReached() {
+		w.WriteHeader(200)
+		return
+	}
+	if e.Results.skipReplayed() {
+		w.WriteHeader(200)
+		return
+	}
+	e.Results.see(endpoint(r.Method, r.URL.Path))
+	if !e.Results.filter(e.opts.Filter, r) {
+		w.WriteHeader(200)
+		return
+	}
+	// Bail if too many concurrent requests, else update concurrency if we are using it
+	if !e.concurrency.decrement() {
+		w.WriteHeader(200)
+		return
+	}
+	defer e.concurrency.increment()
+	// Reserve one of the requests left so no more than MaxReqs are forwarded however many are in flight
+	reserved, ok := e.Results.reserve()
+	if !ok {
+		w.WriteHeader(200)
+		return
+	}
+	defer e.Results.release(reserved)
+	if !e.Results.selectRequest(e.opts.Selector, r, reserved) {
+		w.WriteHeader(200)
+		return
+	}
+
+	// save request for potential diff logging
+	reqDump, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		log.Printf("error dumping request: %s", err)
+	}
+
+	// Body can only be read once so we need to duplicate it
+	reqs, err := duplicateRequest(r, 3)
+	if err != nil {
+		config.KV.ErrorD("duplicating-request-failed", logger.M{"err": err.Error()})
+		return
+	}
+	rControl, rExperiment, rControl2 := reqs[0], reqs[1], reqs[2]
+	for _, target := range []struct {
+		rewriter *Rewriter
+		auth     Authorizer
+		req      *http.Request
+	}{
+		{e.opts.ControlRewriter, e.opts.ControlAuth, rControl},
+		{e.opts.ControlRewriter, e.opts.ControlAuth, rControl2},
+		{e.opts.ExperimentRewriter, e.opts.ExperimentAuth, rExperiment},
+	} {
+		if err := target.rewriter.Rewrite(target.req); err != nil {
+			config.KV.ErrorD("rewriting-request-failed", logger.M{"err": err.Error()})
+			return
+		}
+		if err := authorize(target.auth, target.req); err != nil {
+			config.KV.ErrorD("authorizing-request-failed", logger.M{"err": err.Error()})
+			return
+		}
+	}
+
+	if e.opts.DryRun && !config.IsSafeMethod(r.Method) {
+		e.dryRunWrite(rExperiment)
+		return
+	}
+
+	comparator := e.opts.Comparator
+	ignoredHeaders := comparator.ignoredHeaders()
+	start := time.Now()
+	control, err := forwardRequest(rControl, e.opts.ControlURL, ignoredHeaders)
+	handleForwardErr(control, "control", err)
+	controlLatency := time.Since(start)
+	start = time.Now()
+	experiment, err := forwardRequest(rExperiment, e.opts.ExperimentURL, ignoredHeaders)
+	handleForwardErr(experiment, "experiment", err)
+	experimentLatency := time.Since(start)
+
+	noise := map[string]bool{}
+	control2Failed := false
+	if e.opts.Control2URL != "" {
+		control2, err := forwardRequest(rControl2, e.opts.Control2URL, ignoredHeaders)
+		handleForwardErr(control2, "control2", err)
+		// A failed forward differs from the control in every field, which would hide every diff as noise
+		control2Failed = control2.code == -1
+		if !control2Failed {
+			for _, field := range comparator.diffFields(control, control2) {
+				noise[field] = true
+			}
+		}
+	}
+	route := endpoint(r.Method, r.URL.Path)
+	diffs := comparator.withoutFields(comparator.diffFields(control, experiment), noise, route)
+	hasDiff := len(diffs) > 0
+	var diff Diff
+	if hasDiff {
+		diff = e.opts.Redactor.Diff(Diff{
+			Route:          route,
+			ControlCode:    control.code,
+			ExperimentCode: experiment.code,
+			Fields:         diffs,
+			Request:        string(reqDump),
+			Control:        control.dump,
+			Experiment:     experiment.dump,
+		})
+	}
+
+	res := e.Results
+	res.Mutex.Lock()
+	defer res.Mutex.Unlock()
+	res.countReq(reserved)
+	for field := range noise {
+		if res.Noise == nil {
+			res.Noise = map[string]int{}
+		}
+		res.Noise[field]++
+	}
+	if res.AllCodes == nil {
+		res.AllCodes = map[int]map[int]int{}
+	}
+	addCode(res.AllCodes, control.code, experiment.code)
+	res.updateErrors("control", control.code)
+	res.updateErrors("experiment", experiment.code)
+	if control2Failed {
+		res.updateErrors("control2", -1)
+	}
+	res.updateFieldDiffs(route, diffs)
+	res.updateRoute(route, hasDiff, isErrorCode(experiment.code), experimentLatency, controlLatency)
+
+	if hasDiff {
+		addCode(res.Codes, control.code, experiment.code)
+		res.Diffs++
+		res.recordDiff(diff, e.opts.DiffSampleSize)
+	}
+}
+
+// dryRunWrite sends a write only to the dry run URL or the experiment and counts it
+func (e *Experiment) dryRunWrite(r *http.Request) {
+	addr := e.opts.DryRunURL
+	if addr == "" {
+		addr = e.opts.ExperimentURL
+	}
+	res, err := forwardRequest(r, addr, []string{})
+	handleForwardErr(res, "experiment", err)
+
+	e.Results.Mutex.Lock()
+	defer e.Results.Mutex.Unlock()
+	e.Results.DryRunWrites++
+	e.Results.updateErrors("dry_run", res.code)
+}
+
+// authorize adds credentials to the request if there is an Authorizer
+func authorize(a Authorizer, r *http.Request) error {
+	if a == nil {
+		return nil
+	}
+	return a.Authorize(r)
+}
+
+func (c *concurrency) increment() {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if c.Value != -1 {
+		c.Value++
+	}
+}
+
+func (c *concurrency) decrement() bool {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if c.Value == 0 {
+		return false
+	} else if c.Value > 0 {
+		c.Value--
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package science
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExperiments(t *testing.T) {
+	controlServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"id": 1, "updated_at": 1}`)
+		},
+	))
+	defer controlServer.Close()
+	expServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"id": 1, "updated_at": 2}`)
+		},
+	))
+	defer expServer.Close()
+
+	var diffLog bytes.Buffer
+	strict := NewExperiment(Options{
+		ControlURL:    controlServer.URL,
+		ExperimentURL: expServer.URL,
+		DiffLog:       &diffLog,
+	})
+	lenient := NewExperiment(Options{
+		ControlURL:    controlServer.URL,
+		ExperimentURL: expServer.URL,
+		Comparator:    Comparator{IgnoredBodyPaths: []string{"updated_at"}},
+		Concurrency:   2,
+	})
+
+	// Both run at once in the same process without sharing results
+	wg := sync.WaitGroup{}
+	for _, e := range []*Experiment{strict, lenient} {
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(e *Experiment) {
+				defer wg.Done()
+				e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+			}(e)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, 5, strict.Results.Reqs)
+	assert.Equal(t, 5, strict.Results.Diffs)
+	assert.Equal(t, 5, strict.Results.FieldDiffs["GET /users/:id"].Fields["body.updated_at"])
+	assert.Equal(t, 5, strings.Count(diffLog.String(), "=== diff ==="))
+	// The concurrency limit turns away requests past the first 2 in flight
+	assert.True(t, lenient.Results.Reqs >= 1 && lenient.Results.Reqs <= 5)
+	assert.Equal(t, 0, lenient.Results.Diffs)
+
+	lenient.Drain()
+	rec := httptest.NewRecorder()
+	lenient.ServeHTTP(rec, httptest.NewRequest("GET", "/users/1", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.True(t, lenient.WaitInFlight(0))
+}
+
+func TestExperimentDryRun(t *testing.T) {
+	var controlReqs, expReqs int32
+	controlServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&controlReqs, 1)
+	}))
+	defer controlServer.Close()
+	expServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&expReqs, 1)
+	}))
+	defer expServer.Close()
+
+	e := NewExperiment(Options{ControlURL: controlServer.URL, ExperimentURL: expServer.URL, DryRun: true})
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/users", strings.NewReader("{}")))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/users/1", nil))
+
+	// Writes never reach the control and aren't compared
+	assert.Equal(t, int32(1), atomic.LoadInt32(&controlReqs))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&expReqs))
+	assert.Equal(t, 1, e.Results.Reqs)
+	assert.Equal(t, 2, e.Results.DryRunWrites)
+}
+
+func TestExperimentMaxReqs(t *testing.T) {
+	var forwarded int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&forwarded, 1)
+	}))
+	defer server.Close()
+
+	e := NewExperiment(Options{ControlURL: server.URL, ExperimentURL: server.URL, MaxReqs: 7})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf("/users/%d", i), nil))
+		}(i)
+	}
+	wg.Wait()
+
+	// Exactly MaxReqs are forwarded however many arrive at once
+	assert.Equal(t, 7, e.Results.Reqs)
+	assert.Equal(t, int32(14), atomic.LoadInt32(&forwarded))
+	select {
+	case <-e.Results.ReqsReached():
+	default:
+		t.Fatal("ReqsReached wasn't closed")
+	}
+}
+
+func TestExperimentMaxReqsRelease(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// Dry run writes aren't counted, so they don't use up the limit
+	e := NewExperiment(Options{ControlURL: server.URL, ExperimentURL: server.URL, DryRun: true, MaxReqs: 2})
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/users", strings.NewReader("{}")))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	select {
+	case <-e.Results.ReqsReached():
+		t.Fatal("ReqsReached was closed before MaxReqs")
+	default:
+	}
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/2", nil))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/3", nil))
+	assert.Equal(t, 2, e.Results.Reqs)
+	assert.Equal(t, 1, e.Results.DryRunWrites)
+	assert.Equal(t, 0, e.Results.pending)
+}
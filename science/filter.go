@@ -0,0 +1,188 @@
+package science
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Clever/http-science/config"
+)
+
+// Filter decides which requests are forwarded. A nil Filter forwards every request
+type Filter struct {
+	headers        map[string]*regexp.Regexp
+	excludeHeaders map[string]*regexp.Regexp
+	queryParams    []string
+	body           *regexp.Regexp
+	userAgent      *regexp.Regexp
+	samplePercent  float64
+	maxRouteRate   float64
+	now            func() time.Time
+
+	mutex   *sync.Mutex
+	buckets map[string]*bucket
+}
+
+// bucket is a token bucket limiting the requests forwarded to a route
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewFilter returns a Filter for the config, or nil if it doesn't filter anything
+func NewFilter(c config.Filter) (*Filter, error) {
+	if len(c.Headers) == 0 && len(c.ExcludeHeaders) == 0 && len(c.QueryParams) == 0 && c.BodyRegex == "" &&
+		c.UserAgentRegex == "" && (c.SamplePercent <= 0 || c.SamplePercent >= 100) && c.MaxRouteRate <= 0 {
+		return nil, nil
+	}
+	f := &Filter{
+		queryParams:   c.QueryParams,
+		samplePercent: c.SamplePercent,
+		maxRouteRate:  c.MaxRouteRate,
+		now:           time.Now,
+		mutex:         &sync.Mutex{},
+		buckets:       map[string]*bucket{},
+	}
+	var err error
+	if f.headers, err = compileHeaders(c.Headers); err != nil {
+		return nil, err
+	}
+	if f.excludeHeaders, err = compileHeaders(c.ExcludeHeaders); err != nil {
+		return nil, err
+	}
+	if c.BodyRegex != "" {
+		if f.body, err = regexp.Compile(c.BodyRegex); err != nil {
+			return nil, fmt.Errorf("body_regex %q is not a valid regex: %s", c.BodyRegex, err)
+		}
+	}
+	if c.UserAgentRegex != "" {
+		if f.userAgent, err = regexp.Compile(c.UserAgentRegex); err != nil {
+			return nil, fmt.Errorf("user_agent_regex %q is not a valid regex: %s", c.UserAgentRegex, err)
+		}
+	}
+	return f, nil
+}
+
+func compileHeaders(headers map[string]string) (map[string]*regexp.Regexp, error) {
+	compiled := map[string]*regexp.Regexp{}
+	for h, r := range headers {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("header %s regex %q is not a valid regex: %s", h, r, err)
+		}
+		compiled[http.CanonicalHeaderKey(h)] = re
+	}
+	return compiled, nil
+}
+
+// Allow returns true if the request should be forwarded. The body is read and restored if needed
+func (f *Filter) Allow(r *http.Request) (bool, error) {
+	if f == nil {
+		return true, nil
+	}
+	for h, re := range f.headers {
+		if !headerMatches(r.Header[h], re) {
+			return false, nil
+		}
+	}
+	for h, re := range f.excludeHeaders {
+		if headerMatches(r.Header[h], re) {
+			return false, nil
+		}
+	}
+	query := r.URL.Query()
+	for _, p := range f.queryParams {
+		if _, ok := query[p]; !ok {
+			return false, nil
+		}
+	}
+	if f.userAgent != nil && !f.userAgent.MatchString(r.UserAgent()) {
+		return false, nil
+	}
+
+	if f.body != nil || f.samplePercent > 0 && f.samplePercent < 100 {
+		body, err := readBody(r)
+		if err != nil {
+			return false, err
+		}
+		if f.body != nil && !f.body.Match(body) {
+			return false, nil
+		}
+		if f.samplePercent > 0 && f.samplePercent < 100 && !f.sampled(r, body) {
+			return false, nil
+		}
+	}
+	// The rate limit is checked last so filtered requests don't use up a route's rate
+	return f.underRouteRate(endpoint(r.Method, r.URL.Path)), nil
+}
+
+func headerMatches(values []string, re *regexp.Regexp) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled picks the request by its hash, so the same requests are picked every run
+func (f *Filter) sampled(r *http.Request, body []byte) bool {
+	return float64(requestHash(r, body)%10000) < f.samplePercent*100
+}
+
+// readBody reads the request's body, leaving a copy in its place so it can still be forwarded
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// requestHash hashes the request's method, URL and body
+func requestHash(r *http.Request, body []byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	h.Write(body)
+	return h.Sum64()
+}
+
+// underRouteRate takes a token from the route's bucket, returning false if it is empty
+func (f *Filter) underRouteRate(route string) bool {
+	if f.maxRouteRate <= 0 {
+		return true
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := f.now()
+	// Allow bursts of up to a second's worth of requests
+	burst := f.maxRouteRate
+	if burst < 1 {
+		burst = 1
+	}
+	b, ok := f.buckets[route]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		f.buckets[route] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * f.maxRouteRate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
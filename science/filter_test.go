@@ -0,0 +1,97 @@
+package science
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := NewFilter(config.Filter{})
+	assert.Nil(t, err)
+	assert.Nil(t, f)
+
+	f, err = NewFilter(config.Filter{
+		Headers:        map[string]string{"x-district-id": "^[0-9]+$"},
+		ExcludeHeaders: map[string]string{"X-Debug": ""},
+		QueryParams:    []string{"fields"},
+		BodyRegex:      `"active": ?true`,
+		UserAgentRegex: "^Mozilla",
+	})
+	assert.Nil(t, err)
+
+	allow := func(header map[string]string, path, body string) bool {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.Header.Set("User-Agent", "Mozilla/5.0")
+		r.Header.Set("X-District-Id", "42")
+		for h, v := range header {
+			r.Header.Set(h, v)
+		}
+		allowed, err := f.Allow(r)
+		assert.Nil(t, err)
+		if allowed {
+			// The body can still be forwarded
+			forwarded, _ := ioutil.ReadAll(r.Body)
+			assert.Equal(t, body, string(forwarded))
+		}
+		return allowed
+	}
+	assert.True(t, allow(nil, "/users?fields=name", `{"active": true}`))
+	assert.False(t, allow(map[string]string{"X-District-Id": "abc"}, "/users?fields=name", `{"active": true}`))
+	assert.False(t, allow(map[string]string{"X-Debug": "1"}, "/users?fields=name", `{"active": true}`))
+	assert.False(t, allow(map[string]string{"User-Agent": "curl/7.0"}, "/users?fields=name", `{"active": true}`))
+	assert.False(t, allow(nil, "/users", `{"active": true}`))
+	assert.False(t, allow(nil, "/users?fields=name", `{"active": false}`))
+}
+
+func TestFilterSample(t *testing.T) {
+	f, err := NewFilter(config.Filter{SamplePercent: 25})
+	assert.Nil(t, err)
+	sampled := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("/users/%d", i)
+		allowed, err := f.Allow(httptest.NewRequest("GET", path, nil))
+		assert.Nil(t, err)
+		sampled[path] = allowed
+	}
+	count := 0
+	for path, allowed := range sampled {
+		if allowed {
+			count++
+		}
+		// The same requests are picked every time
+		again, _ := f.Allow(httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, allowed, again)
+	}
+	assert.InDelta(t, 250, count, 50)
+}
+
+func TestFilterRouteRate(t *testing.T) {
+	f, err := NewFilter(config.Filter{MaxRouteRate: 2})
+	assert.Nil(t, err)
+	now := time.Now()
+	f.now = func() time.Time { return now }
+	allowed := func(path string) int {
+		n := 0
+		for i := 0; i < 10; i++ {
+			if ok, _ := f.Allow(httptest.NewRequest("GET", path, nil)); ok {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Each route gets its own rate, with IDs normalized
+	assert.Equal(t, 2, allowed("/users/1"))
+	assert.Equal(t, 0, allowed("/users/2"))
+	assert.Equal(t, 2, allowed("/schools"))
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, 1, allowed("/users/3"))
+}
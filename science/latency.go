@@ -0,0 +1,86 @@
+package science
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// latencySamples is the max number of samples we keep to estimate percentiles
+const latencySamples = 10000
+
+// Latency records the distribution of response times. Percentiles are estimated from a uniform
+// sample so memory stays bounded on long runs
+type Latency struct {
+	Count   int
+	Total   time.Duration
+	Max     time.Duration
+	Samples []time.Duration
+}
+
+// Add records a response time
+func (l *Latency) Add(d time.Duration) {
+	l.Count++
+	l.Total += d
+	if d > l.Max {
+		l.Max = d
+	}
+	if len(l.Samples) < latencySamples {
+		l.Samples = append(l.Samples, d)
+	} else if i := rand.Intn(l.Count); i < latencySamples {
+		l.Samples[i] = d
+	}
+}
+
+// Mean returns the average response time
+func (l *Latency) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+// Percentile returns the estimated response time at percentile p, between 0 and 100
+func (l *Latency) Percentile(p float64) time.Duration {
+	if len(l.Samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(l.Samples))
+	copy(sorted, l.Samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// Nearest-rank method
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// Merge adds the response times recorded in o. The samples are combined in proportion to how
+// many responses each recorded, so percentiles stay an estimate over both
+func (l *Latency) Merge(o *Latency) {
+	if o == nil || o.Count == 0 {
+		return
+	}
+	total := l.Count + o.Count
+	samples := append(subsample(l.Samples, latencySamples*l.Count/total), subsample(o.Samples, latencySamples*o.Count/total)...)
+	l.Count = total
+	l.Total += o.Total
+	if o.Max > l.Max {
+		l.Max = o.Max
+	}
+	l.Samples = samples
+}
+
+// subsample returns up to n of the samples chosen at random
+func subsample(samples []time.Duration, n int) []time.Duration {
+	if len(samples) <= n {
+		return append([]time.Duration{}, samples...)
+	}
+	picked := []time.Duration{}
+	for _, i := range rand.Perm(len(samples))[:n] {
+		picked = append(picked, samples[i])
+	}
+	return picked
+}
@@ -0,0 +1,81 @@
+package science
+
+// reqsReached returns true if MaxReqs requests have been forwarded, so no more will be
+func (r *Results) reqsReached() bool {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	return r.MaxReqs > 0 && r.Reqs >= r.MaxReqs
+}
+
+// reservation is a request's claim on one of the requests left before MaxReqs
+type reservation struct {
+	// held is true until the request is counted in Reqs or the reservation is released
+	held bool
+	// selection is the Selector's pick of the request, undone if it is released without being counted
+	selection *selection
+}
+
+// reserve claims one of the requests left before MaxReqs, returning false if they are all forwarded or
+// being forwarded. Every reservation must be released, which does nothing once the request is counted
+func (r *Results) reserve() (*reservation, bool) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if r.MaxReqs <= 0 {
+		return &reservation{}, true
+	}
+	if r.Reqs+r.pending >= r.MaxReqs {
+		return nil, false
+	}
+	r.pending++
+	return &reservation{held: true}, true
+}
+
+// release gives back the reservation of a request that wasn't counted in Reqs, so it doesn't use up the limit
+func (r *Results) release(res *reservation) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if res.selection != nil {
+		res.selection.undo()
+	}
+	r.consume(res)
+}
+
+// countReq counts a forwarded request in Reqs and uses up its reservation, so Reqs+pending never
+// counts it twice. r.Mutex must be held
+func (r *Results) countReq(res *reservation) {
+	r.Reqs++
+	r.consume(res)
+	r.checkReqsReached()
+}
+
+// consume removes the reservation from pending and keeps its selection. r.Mutex must be held
+func (r *Results) consume(res *reservation) {
+	res.selection = nil
+	if res.held {
+		r.pending--
+		res.held = false
+	}
+}
+
+// ReqsReached returns a channel that is closed once MaxReqs requests have been forwarded
+func (r *Results) ReqsReached() <-chan struct{} {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	r.checkReqsReached()
+	return r.reached
+}
+
+// checkReqsReached closes r.reached if MaxReqs requests have been forwarded. r.Mutex must be held
+func (r *Results) checkReqsReached() {
+	if r.reached == nil {
+		r.reached = make(chan struct{})
+	}
+	if r.MaxReqs <= 0 || r.Reqs < r.MaxReqs {
+		return
+	}
+	select {
+	case <-r.reached:
+	default:
+		close(r.reached)
+	}
+}
@@ -0,0 +1,32 @@
+package science
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReservation(t *testing.T) {
+	r := &Results{MaxReqs: 2, Mutex: &sync.Mutex{}}
+	counted, ok := r.reserve()
+	assert.True(t, ok)
+	dropped, ok := r.reserve()
+	assert.True(t, ok)
+	_, ok = r.reserve()
+	assert.False(t, ok)
+
+	// Counting a request uses up its reservation, so releasing it after does nothing
+	r.Mutex.Lock()
+	r.countReq(counted)
+	r.Mutex.Unlock()
+	assert.Equal(t, 1, r.pending)
+	r.release(counted)
+	assert.Equal(t, 1, r.pending)
+
+	r.release(dropped)
+	assert.Equal(t, 0, r.pending)
+	_, ok = r.reserve()
+	assert.True(t, ok)
+	assert.Equal(t, 1, r.Reqs)
+}
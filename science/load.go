@@ -3,20 +3,86 @@ package science
 import (
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/Clever/http-science/config"
 )
 
 // LoadTest is the interface to run load tests with
 type LoadTest struct {
 	URL string
+	// Rewriter changes requests before they are forwarded, it can be nil
+	Rewriter *Rewriter
+	// Auth adds credentials to requests after they are rewritten, it can be nil
+	Auth Authorizer
+	// DryRunURL is where writes are sent instead of URL if set. They are counted as dry run writes
+	// and not load tested
+	DryRunURL string
+	// Filter decides which requests are forwarded, then Selector picks from them. Either can be nil
+	Filter   *Filter
+	Selector *Selector
 }
 
 func (l LoadTest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_, err := forwardRequest(r, l.URL, []string{})
+	if !inFlight.start() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer inFlight.finish()
+	if Res.reqsReached() || Res.skipReplayed() {
+		return
+	}
+	Res.see(endpoint(r.Method, r.URL.Path))
+	if !Res.filter(l.Filter, r) {
+		return
+	}
+	reserved, ok := Res.reserve()
+	if !ok {
+		return
+	}
+	defer Res.release(reserved)
+	if !Res.selectRequest(l.Selector, r, reserved) {
+		return
+	}
+	if err := l.Rewriter.Rewrite(r); err != nil {
+		log.Printf("Error rewriting request: %s", err)
+		return
+	}
+	if err := authorize(l.Auth, r); err != nil {
+		log.Printf("Error authorizing request: %s", err)
+		return
+	}
+	if l.DryRunURL != "" && !config.IsSafeMethod(r.Method) {
+		res, err := forwardRequest(r, l.DryRunURL, []string{})
+		Res.Mutex.Lock()
+		defer Res.Mutex.Unlock()
+		Res.DryRunWrites++
+		if err != nil {
+			log.Printf("Error forwarding request: %s", err)
+			res.code = -1
+		}
+		Res.updateErrors("dry_run", res.code)
+		return
+	}
+	start := time.Now()
+	res, err := forwardRequest(r, l.URL, []string{})
+	latency := time.Since(start)
+	route := endpoint(r.Method, r.URL.Path)
+
+	Res.Mutex.Lock()
+	defer Res.Mutex.Unlock()
 	if err != nil {
 		log.Printf("Error forwarding request: %s", err)
+		Res.updateErrors("load", -1)
+		Res.updateRoute(route, false, true, latency, 0)
 		return
 	}
-	Res.Mutex.Lock()
-	Res.Reqs++
-	Res.Mutex.Unlock()
+	Res.countReq(reserved)
+	if Res.AllCodes == nil {
+		Res.AllCodes = map[int]map[int]int{}
+	}
+	// There is no control in a load test, count the codes under control code 0
+	addCode(Res.AllCodes, 0, res.code)
+	Res.updateErrors("load", res.code)
+	Res.updateRoute(route, false, isErrorCode(res.code), latency, 0)
 }
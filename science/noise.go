@@ -0,0 +1,145 @@
+package science
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// noiseThreshold is the fraction of an endpoint's requests a field must differ in to be flagged as noise
+const noiseThreshold = 0.95
+
+// noiseMinReqs is the number of requests an endpoint needs before we flag any of its fields as noise
+const noiseMinReqs = 10
+
+// FieldStats tracks how often each field differed for a single endpoint
+type FieldStats struct {
+	Reqs   int
+	Fields map[string]int
+}
+
+// FieldFrequency is how often a field differed for an endpoint
+type FieldFrequency struct {
+	Endpoint  string  `json:"endpoint"`
+	Field     string  `json:"field"`
+	Diffs     int     `json:"diffs"`
+	Reqs      int     `json:"reqs"`
+	Frequency float64 `json:"frequency"`
+}
+
+// NoiseReport groups the fields that differed into likely noise and likely regressions
+type NoiseReport struct {
+	LikelyNoise      []FieldFrequency `json:"likely_noise"`
+	LikelyRegression []FieldFrequency `json:"likely_regression"`
+	Suggested        SuggestedConfig  `json:"suggested_config"`
+}
+
+// SuggestedConfig is the payload config that would ignore the noise found in this run
+type SuggestedConfig struct {
+	IgnoredHeaders   []string `json:"ignored_headers"`
+	IgnoredBodyPaths []string `json:"ignored_body_paths"`
+}
+
+// updateFieldDiffs records the fields that differed for a request to the endpoint. r.Mutex must be held
+func (r *Results) updateFieldDiffs(endpoint string, fields []string) {
+	if r.FieldDiffs == nil {
+		r.FieldDiffs = map[string]*FieldStats{}
+	}
+	stats, ok := r.FieldDiffs[endpoint]
+	if !ok {
+		stats = &FieldStats{Fields: map[string]int{}}
+		r.FieldDiffs[endpoint] = stats
+	}
+	stats.Reqs++
+	for _, field := range fields {
+		stats.Fields[field]++
+	}
+}
+
+// isIgnoredField returns true if the field is covered by the comparator's ignored body paths, or the
+// ignored headers and body paths of a rule for the route
+func (c Comparator) isIgnoredField(field, route string) bool {
+	for _, path := range c.IgnoredBodyPaths {
+		if isUnderBodyPath(field, path) {
+			return true
+		}
+	}
+	for _, rule := range c.RouteRules {
+		if !rule.Matches(route) {
+			continue
+		}
+		for _, header := range rule.IgnoredHeaders {
+			if field == "header."+http.CanonicalHeaderKey(header) {
+				return true
+			}
+		}
+		for _, path := range rule.IgnoredBodyPaths {
+			if isUnderBodyPath(field, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isUnderBodyPath returns true if the field is the body path or inside it
+func isUnderBodyPath(field, path string) bool {
+	ignored := "body." + path
+	return field == ignored || strings.HasPrefix(field, ignored+".") || strings.HasPrefix(field, ignored+"[]")
+}
+
+// LearnedNoise returns the fields that differed during the run grouped into likely noise and likely regressions
+func (r *Results) LearnedNoise() NoiseReport {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	report := NoiseReport{LikelyNoise: []FieldFrequency{}, LikelyRegression: []FieldFrequency{}}
+	// A field is only suggested if it is noise on every endpoint it differs on
+	noiseOnly := map[string]bool{}
+	for ep, stats := range r.FieldDiffs {
+		for field, diffs := range stats.Fields {
+			freq := FieldFrequency{
+				Endpoint:  ep,
+				Field:     field,
+				Diffs:     diffs,
+				Reqs:      stats.Reqs,
+				Frequency: float64(diffs) / float64(stats.Reqs),
+			}
+			isNoise := stats.Reqs >= noiseMinReqs && freq.Frequency >= noiseThreshold
+			if isNoise {
+				report.LikelyNoise = append(report.LikelyNoise, freq)
+			} else {
+				report.LikelyRegression = append(report.LikelyRegression, freq)
+			}
+			if prev, ok := noiseOnly[field]; !ok || prev {
+				noiseOnly[field] = isNoise
+			}
+		}
+	}
+	sortFrequencies(report.LikelyNoise)
+	sortFrequencies(report.LikelyRegression)
+
+	report.Suggested = SuggestedConfig{IgnoredHeaders: []string{}, IgnoredBodyPaths: []string{}}
+	for field, isNoise := range noiseOnly {
+		if !isNoise {
+			continue
+		}
+		if strings.HasPrefix(field, "header.") {
+			report.Suggested.IgnoredHeaders = append(report.Suggested.IgnoredHeaders, strings.TrimPrefix(field, "header."))
+		} else if strings.HasPrefix(field, "body.") {
+			report.Suggested.IgnoredBodyPaths = append(report.Suggested.IgnoredBodyPaths, strings.TrimPrefix(field, "body."))
+		}
+	}
+	sort.Strings(report.Suggested.IgnoredHeaders)
+	sort.Strings(report.Suggested.IgnoredBodyPaths)
+	return report
+}
+
+func sortFrequencies(freqs []FieldFrequency) {
+	sort.Slice(freqs, func(i, j int) bool {
+		if freqs[i].Endpoint != freqs[j].Endpoint {
+			return freqs[i].Endpoint < freqs[j].Endpoint
+		}
+		return freqs[i].Field < freqs[j].Field
+	})
+}
@@ -0,0 +1,53 @@
+package science
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Clever/http-science/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLearnedNoise(t *testing.T) {
+	Res = Results{Mutex: &sync.Mutex{}}
+	for i := 0; i < 20; i++ {
+		fields := []string{"header.X-Generated", "body.updated_at"}
+		if i == 0 {
+			fields = append(fields, "body.name")
+		}
+		Res.updateFieldDiffs(endpoint("GET", "/users"), fields)
+	}
+	// Too few requests to call anything noise
+	Res.updateFieldDiffs(endpoint("GET", "/schools"), []string{"body.updated_at"})
+
+	report := Res.LearnedNoise()
+	assert.Equal(t, []FieldFrequency{
+		{Endpoint: "GET /users", Field: "body.updated_at", Diffs: 20, Reqs: 20, Frequency: 1},
+		{Endpoint: "GET /users", Field: "header.X-Generated", Diffs: 20, Reqs: 20, Frequency: 1},
+	}, report.LikelyNoise)
+	assert.Equal(t, []FieldFrequency{
+		{Endpoint: "GET /schools", Field: "body.updated_at", Diffs: 1, Reqs: 1, Frequency: 1},
+		{Endpoint: "GET /users", Field: "body.name", Diffs: 1, Reqs: 20, Frequency: 0.05},
+	}, report.LikelyRegression)
+	// updated_at is not noise on every endpoint so isn't suggested
+	assert.Equal(t, SuggestedConfig{IgnoredHeaders: []string{"X-Generated"}, IgnoredBodyPaths: []string{}}, report.Suggested)
+}
+
+func TestIgnoredBodyPaths(t *testing.T) {
+	c := Comparator{IgnoredBodyPaths: []string{"users[].updated_at", "meta"}}
+
+	diffs := []string{"body.users[].updated_at", "body.users[].name", "body.meta.next", "body.metadata", "code"}
+	assert.Equal(t, []string{"body.users[].name", "body.metadata", "code"}, c.withoutFields(diffs, map[string]bool{}, ""))
+}
+
+func TestRouteRules(t *testing.T) {
+	c := Comparator{RouteRules: []config.RouteRule{
+		{Route: "GET /v1/users/:id", IgnoredHeaders: []string{"x-cache"}},
+		{Route: "/v1/schools", IgnoredBodyPaths: []string{"data[].updated_at"}},
+	}}
+
+	diffs := []string{"header.X-Cache", "body.data[].updated_at"}
+	assert.Equal(t, []string{"body.data[].updated_at"}, c.withoutFields(diffs, map[string]bool{}, "GET /v1/users/:id"))
+	assert.Equal(t, []string{"header.X-Cache"}, c.withoutFields(diffs, map[string]bool{}, "POST /v1/schools"))
+	assert.Equal(t, diffs, c.withoutFields(diffs, map[string]bool{}, "GET /v1/sections"))
+}
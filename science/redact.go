@@ -0,0 +1,224 @@
+package science
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Clever/http-science/config"
+)
+
+// DefaultRedactedHeaders are always redacted from diffs
+var DefaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// Redactor replaces sensitive data in diffs with stable hashes, so the same value is replaced the same
+// way in the control and experiment and diffs stay comparable. A nil Redactor doesn't change anything
+type Redactor struct {
+	headers   map[string]bool
+	bodyPaths map[string]bool
+	patterns  []*regexp.Regexp
+	key       []byte
+}
+
+// NewRedactor returns a Redactor for the default headers and the ones in the config
+func NewRedactor(r config.Redact) (*Redactor, error) {
+	rd := &Redactor{headers: map[string]bool{}, bodyPaths: map[string]bool{}}
+	for _, h := range append(DefaultRedactedHeaders, r.Headers...) {
+		rd.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, p := range r.BodyPaths {
+		rd.bodyPaths[p] = true
+	}
+	for _, p := range r.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid regex: %s", p, err)
+		}
+		rd.patterns = append(rd.patterns, re)
+	}
+	if r.HashKeyEnv != "" {
+		rd.key = []byte(os.Getenv(r.HashKeyEnv))
+		if len(rd.key) == 0 {
+			return nil, fmt.Errorf("%s is not set", r.HashKeyEnv)
+		}
+	} else {
+		rd.key = make([]byte, 32)
+		if _, err := rand.Read(rd.key); err != nil {
+			return nil, err
+		}
+	}
+	return rd, nil
+}
+
+// Diff returns the diff with its request and responses redacted
+func (rd *Redactor) Diff(d Diff) Diff {
+	if rd == nil {
+		return d
+	}
+	d.Request = rd.request(d.Request)
+	d.Control = rd.response(d.Control)
+	d.Experiment = rd.response(d.Experiment)
+	return d
+}
+
+// request redacts a raw HTTP request. Dumps that can't be parsed only have patterns redacted
+func (rd *Redactor) request(dump string) string {
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(dump)))
+	if err != nil {
+		return rd.text(dump)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return rd.text(dump)
+	}
+	r.RequestURI = rd.text(r.RequestURI)
+	r.Host = rd.text(r.Host)
+	rd.header(r.Header)
+	body = rd.body(decode(r.Header, body))
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	// The body was read unchunked so it is written back with its length
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	if r.Header.Get("Content-Length") != "" || len(body) > 0 {
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	redacted, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		return rd.text(dump)
+	}
+	return string(redacted)
+}
+
+// response redacts a raw HTTP response. Dumps that can't be parsed, like forwarding errors, only have
+// patterns redacted
+func (rd *Redactor) response(dump string) string {
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(dump)), nil)
+	if err != nil {
+		return rd.text(dump)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return rd.text(dump)
+	}
+	rd.header(res.Header)
+	body = rd.body(decode(res.Header, body))
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.TransferEncoding = nil
+	redacted, err := httputil.DumpResponse(res, true)
+	if err != nil {
+		return rd.text(dump)
+	}
+	return string(redacted)
+}
+
+func (rd *Redactor) header(h http.Header) {
+	for name, values := range h {
+		for i, v := range values {
+			if rd.headers[name] {
+				values[i] = rd.hash(v)
+			} else {
+				values[i] = rd.text(v)
+			}
+		}
+	}
+}
+
+// undecodable replaces bodies that can't be decoded to be redacted
+const undecodable = "http-science: body with Content-Encoding %s removed, it can't be redacted"
+
+// decode decodes a gzip or deflate body so it can be redacted, removing its Content-Encoding. Bodies in
+// other encodings can't be redacted, so they are replaced with a note
+func decode(h http.Header, body []byte) []byte {
+	encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || len(body) == 0 {
+		return body
+	}
+	h.Del("Content-Encoding")
+	var reader io.ReadCloser
+	var err error
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		err = fmt.Errorf("unsupported encoding")
+	}
+	if err != nil {
+		return []byte(fmt.Sprintf(undecodable, encoding))
+	}
+	defer reader.Close()
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return []byte(fmt.Sprintf(undecodable, encoding))
+	}
+	return decoded
+}
+
+// body redacts the body paths of JSON bodies, then patterns
+func (rd *Redactor) body(body []byte) []byte {
+	if len(rd.bodyPaths) > 0 {
+		var decoded interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if dec.Decode(&decoded) == nil {
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			if enc.Encode(rd.json(decoded, "")) == nil {
+				body = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+			}
+		}
+	}
+	return []byte(rd.text(string(body)))
+}
+
+// json redacts the values at the body paths. path is built like the paths of body diffs
+func (rd *Redactor) json(v interface{}, path string) interface{} {
+	if rd.bodyPaths[strings.TrimPrefix(path, ".")] {
+		value, _ := json.Marshal(v)
+		return rd.hash(string(value))
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = rd.json(child, path+"."+k)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = rd.json(elem, path+"[]")
+		}
+	}
+	return v
+}
+
+// text redacts the matches of the patterns
+func (rd *Redactor) text(s string) string {
+	for _, re := range rd.patterns {
+		s = re.ReplaceAllStringFunc(s, rd.hash)
+	}
+	return s
+}
+
+// hash returns what a value is replaced with, the same for the same value within a Redactor
+func (rd *Redactor) hash(value string) string {
+	mac := hmac.New(sha256.New, rd.key)
+	mac.Write([]byte(value))
+	return "redacted:" + hex.EncodeToString(mac.Sum(nil))[:12]
+}
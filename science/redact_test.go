@@ -0,0 +1,102 @@
+package science
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+)
+
+func TestRedactor(t *testing.T) {
+	rd, err := NewRedactor(config.Redact{
+		Headers:   []string{"x-api-key"},
+		BodyPaths: []string{"students[].name", "token"},
+		Patterns:  []string{`[a-z]+@example\.com`},
+	})
+	assert.Nil(t, err)
+
+	controlBody := `{"students": [{"name": "Ann", "id": 1}], "contact": "ann@example.com"}`
+	d := rd.Diff(Diff{
+		Route:      "POST /v1/students",
+		Request:    "POST /v1/students?email=ann@example.com HTTP/1.1\r\nHost: localhost:8000\r\nAuthorization: Bearer secret\r\nX-Api-Key: key\r\nContent-Length: 17\r\n\r\n{\"token\": \"abcd\"}",
+		Control:    fmt.Sprintf("HTTP/1.1 200 OK\r\nSet-Cookie: session=1\r\nContent-Length: %d\r\n\r\n%s", len(controlBody), controlBody),
+		Experiment: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n1a\r\n{\"students\": [{\"name\": \"Bo\r\n16\r\nb\", \"id\": 1}], \"x\": 1}\r\n0\r\n\r\n",
+	})
+	assert.Equal(t, "POST /v1/students", d.Route)
+	for _, secret := range []string{"secret", "key\r", "abcd", "ann@example.com", "session=1", "Ann", "Bob"} {
+		assert.NotContains(t, d.Request+d.Control+d.Experiment, secret)
+	}
+
+	// Values are replaced with the same hash everywhere
+	email := rd.hash("ann@example.com")
+	assert.Contains(t, d.Request, "POST /v1/students?email="+email+" HTTP/1.1\r\n")
+	assert.Contains(t, d.Control, `"contact":"`+email+`"`)
+	assert.Contains(t, d.Control, `"id":1,"name":"`+rd.hash(`"Ann"`)+`"`)
+	assert.Contains(t, d.Request, "Authorization: "+rd.hash("Bearer secret")+"\r\n")
+
+	// Redacted dumps can still be parsed with their new lengths
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(d.Request)))
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(req.Body)
+	assert.Equal(t, `{"token":"`+rd.hash(`"abcd"`)+`"}`, string(body))
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(d.Experiment)), nil)
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Equal(t, `{"students":[{"id":1,"name":"`+rd.hash(`"Bob"`)+`"}],"x":1}`, string(body))
+
+	// Forwarding errors aren't HTTP but are still redacted
+	d = rd.Diff(Diff{Control: "Error forwarding request ann@example.com"})
+	assert.Equal(t, "Error forwarding request "+email, d.Control)
+
+	var nilRedactor *Redactor
+	assert.Equal(t, Diff{Request: "GET / HTTP/1.1\r\nAuthorization: a\r\n\r\n"}, nilRedactor.Diff(Diff{Request: "GET / HTTP/1.1\r\nAuthorization: a\r\n\r\n"}))
+}
+
+func TestRedactorHashKey(t *testing.T) {
+	a, err := NewRedactor(config.Redact{})
+	assert.Nil(t, err)
+	b, err := NewRedactor(config.Redact{})
+	assert.Nil(t, err)
+	assert.NotEqual(t, a.hash("value"), b.hash("value"))
+
+	t.Setenv("HTTP_SCIENCE_TEST_HASH_KEY", "key")
+	a, err = NewRedactor(config.Redact{HashKeyEnv: "HTTP_SCIENCE_TEST_HASH_KEY"})
+	assert.Nil(t, err)
+	b, err = NewRedactor(config.Redact{HashKeyEnv: "HTTP_SCIENCE_TEST_HASH_KEY"})
+	assert.Nil(t, err)
+	assert.Equal(t, a.hash("value"), b.hash("value"))
+}
+
+func TestRedactorEncodedBodies(t *testing.T) {
+	rd, err := NewRedactor(config.Redact{BodyPaths: []string{"token"}})
+	assert.Nil(t, err)
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(`{"token": "abcd"}`))
+	gz.Close()
+
+	// Compressed bodies are decoded so they can be redacted
+	d := rd.Diff(Diff{
+		Control:    fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s", gzipped.Len(), gzipped.String()),
+		Experiment: "HTTP/1.1 200 OK\r\nContent-Encoding: br\r\nContent-Length: 4\r\n\r\nabcd",
+	})
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(d.Control)), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, `{"token":"`+rd.hash(`"abcd"`)+`"}`, string(body))
+
+	// Bodies that can't be decoded are removed
+	res, err = http.ReadResponse(bufio.NewReader(strings.NewReader(d.Experiment)), nil)
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Equal(t, "http-science: body with Content-Encoding br removed, it can't be redacted", string(body))
+}
@@ -0,0 +1,160 @@
+package science
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Clever/http-science/config"
+)
+
+// Rewriter changes requests before they are forwarded to a target. A nil Rewriter doesn't change anything
+type Rewriter struct {
+	rewrites []compiledRewrite
+}
+
+type compiledRewrite struct {
+	config.Rewrite
+	headers []compiledReplace
+	path    []compiledReplace
+	query   []compiledReplace
+}
+
+type compiledReplace struct {
+	config.Replace
+	re *regexp.Regexp
+}
+
+// NewRewriter returns a Rewriter that applies the rewrites in order. It returns nil if none change anything
+func NewRewriter(rewrites ...config.Rewrite) (*Rewriter, error) {
+	rw := &Rewriter{}
+	for _, r := range rewrites {
+		if r.IsEmpty() {
+			continue
+		}
+		c := compiledRewrite{Rewrite: r}
+		var err error
+		if c.headers, err = compileReplaces(r.ReplaceHeaders); err != nil {
+			return nil, err
+		}
+		if c.path, err = compileReplaces(r.Path); err != nil {
+			return nil, err
+		}
+		if c.query, err = compileReplaces(r.Query); err != nil {
+			return nil, err
+		}
+		rw.rewrites = append(rw.rewrites, c)
+	}
+	if len(rw.rewrites) == 0 {
+		return nil, nil
+	}
+	return rw, nil
+}
+
+func compileReplaces(replaces []config.Replace) ([]compiledReplace, error) {
+	compiled := []compiledReplace{}
+	for _, r := range replaces {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid regex: %s", r.Pattern, err)
+		}
+		compiled = append(compiled, compiledReplace{Replace: r, re: re})
+	}
+	return compiled, nil
+}
+
+// Rewrite changes the request in place. The request's header and URL must not be shared with other requests
+func (rw *Rewriter) Rewrite(r *http.Request) error {
+	if rw == nil {
+		return nil
+	}
+	for _, c := range rw.rewrites {
+		for _, h := range c.RemoveHeaders {
+			r.Header.Del(h)
+		}
+		for h, v := range c.SetHeaders {
+			r.Header.Set(h, v)
+		}
+		for _, rep := range c.headers {
+			values := r.Header[http.CanonicalHeaderKey(rep.Header)]
+			for i, v := range values {
+				values[i] = rep.re.ReplaceAllString(v, rep.Replacement)
+			}
+		}
+		if c.Host != "" {
+			r.Host = c.Host
+		}
+		for _, rep := range c.path {
+			r.URL.Path = rep.re.ReplaceAllString(r.URL.Path, rep.Replacement)
+			r.URL.RawPath = ""
+		}
+		for _, rep := range c.query {
+			r.URL.RawQuery = rep.re.ReplaceAllString(r.URL.RawQuery, rep.Replacement)
+		}
+		if len(c.Body) > 0 {
+			if err := rewriteBody(r, c.Body); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteBody sets fields of a JSON body. Bodies that aren't JSON objects are left alone
+func rewriteBody(r *http.Request, fields map[string]interface{}) error {
+	if r.Body == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	var decoded map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if dec.Decode(&decoded) == nil {
+		for path, value := range fields {
+			setJSONPath(decoded, strings.Split(path, "."), value)
+		}
+		if body, err = json.Marshal(decoded); err != nil {
+			return err
+		}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	if r.Header.Get("Content-Length") != "" {
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+// setJSONPath sets the field at path in v, where a segment ending in [] is every element of an array.
+// Fields that don't exist yet are only added at the end of the path
+func setJSONPath(v map[string]interface{}, path []string, value interface{}) {
+	key := path[0]
+	if !strings.HasSuffix(key, "[]") {
+		if len(path) == 1 {
+			v[key] = value
+		} else if child, ok := v[key].(map[string]interface{}); ok {
+			setJSONPath(child, path[1:], value)
+		}
+		return
+	}
+	elems, ok := v[strings.TrimSuffix(key, "[]")].([]interface{})
+	if !ok {
+		return
+	}
+	for i, elem := range elems {
+		if len(path) == 1 {
+			elems[i] = value
+		} else if child, ok := elem.(map[string]interface{}); ok {
+			setJSONPath(child, path[1:], value)
+		}
+	}
+}
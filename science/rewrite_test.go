@@ -0,0 +1,80 @@
+package science
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+)
+
+func TestRewrite(t *testing.T) {
+	rw, err := NewRewriter(
+		config.Rewrite{
+			RemoveHeaders: []string{"cookie"},
+			SetHeaders:    map[string]string{"Authorization": "Bearer fresh"},
+		},
+		config.Rewrite{
+			ReplaceHeaders: []config.Replace{{Header: "referer", Pattern: `prod\.example\.com`, Replacement: "staging.example.com"}},
+			Host:           "staging.example.com",
+			Path:           []config.Replace{{Pattern: `^/v1/`, Replacement: "/v2/"}},
+			Query:          []config.Replace{{Pattern: `cursor=[^&]*`, Replacement: "cursor="}},
+			Body:           map[string]interface{}{"token": "fresh", "items[].cursor": nil, "missing.field": 1},
+		},
+	)
+	assert.Nil(t, err)
+
+	r := httptest.NewRequest("POST", "/v1/users?cursor=abc&limit=10", strings.NewReader(`{"token": "old", "items": [{"cursor": "a"}, {"cursor": "b"}], "n": 12345678901234567890}`))
+	r.Header.Set("Cookie", "session=1")
+	r.Header.Set("Referer", "https://prod.example.com/home")
+	r.Header.Set("Content-Length", "87")
+	assert.Nil(t, rw.Rewrite(r))
+
+	assert.Equal(t, "", r.Header.Get("Cookie"))
+	assert.Equal(t, "Bearer fresh", r.Header.Get("Authorization"))
+	assert.Equal(t, "https://staging.example.com/home", r.Header.Get("Referer"))
+	assert.Equal(t, "staging.example.com", r.Host)
+	assert.Equal(t, "/v2/users?cursor=&limit=10", r.URL.RequestURI())
+	body, err := ioutil.ReadAll(r.Body)
+	assert.Nil(t, err)
+	expected := `{"items":[{"cursor":null},{"cursor":null}],"n":12345678901234567890,"token":"fresh"}`
+	assert.Equal(t, expected, string(body))
+	assert.Equal(t, int64(len(expected)), r.ContentLength)
+	assert.Equal(t, fmt.Sprint(len(expected)), r.Header.Get("Content-Length"))
+
+	// Nothing to rewrite
+	rw, err = NewRewriter(config.Rewrite{}, config.Rewrite{})
+	assert.Nil(t, err)
+	assert.Nil(t, rw)
+	assert.Nil(t, rw.Rewrite(r))
+
+	_, err = NewRewriter(config.Rewrite{Path: []config.Replace{{Pattern: "("}}})
+	assert.NotNil(t, err)
+}
+
+func TestExperimentRewritesPerTarget(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer fresh" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		},
+	))
+	defer authServer.Close()
+
+	fresh := config.Rewrite{SetHeaders: map[string]string{"Authorization": "Bearer fresh"}}
+	controlRewriter, err := NewRewriter(fresh)
+	assert.Nil(t, err)
+	e := NewExperiment(Options{
+		ControlURL:      authServer.URL,
+		ExperimentURL:   authServer.URL,
+		ControlRewriter: controlRewriter,
+	})
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, map[int]map[int]int{401: {200: 1}}, e.Results.Codes)
+}
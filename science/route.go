@@ -0,0 +1,119 @@
+package science
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment     = regexp.MustCompile(`^[0-9a-fA-F]{24,}$`)
+	shortHex       = regexp.MustCompile(`^[0-9a-fA-F]{6,}$`)
+	versionSegment = regexp.MustCompile(`^v[0-9]+$`)
+	hasDigit       = regexp.MustCompile(`[0-9]`)
+)
+
+// RouteStats records results for a single normalized route
+type RouteStats struct {
+	Reqs   int
+	Diffs  int
+	Errors int
+	// Latency is of the experiment for correctness tests, or the target for load tests
+	Latency        *Latency
+	ControlLatency *Latency
+}
+
+// NormalizeRoute collapses the IDs, UUIDs and numeric segments of a path to ":id",
+// e.g. /v1/users/abc123 becomes /v1/users/:id
+func NormalizeRoute(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if isIDSegment(seg) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isIDSegment(seg string) bool {
+	switch {
+	case seg == "" || versionSegment.MatchString(seg):
+		return false
+	case numericSegment.MatchString(seg), uuidSegment.MatchString(seg), hexSegment.MatchString(seg):
+		return true
+	}
+	// Hex that mixes in digits, like abc123, is most likely a generated ID. Words with a number in
+	// them, like oauth2 or sha256, aren't hex. Other IDs have to be long and at least half digits
+	if shortHex.MatchString(seg) && hasDigit.MatchString(seg) {
+		return true
+	}
+	return len(seg) >= 8 && 2*digits(seg) >= len(seg)
+}
+
+func digits(s string) int {
+	n := 0
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			n++
+		}
+	}
+	return n
+}
+
+// endpoint returns the key we group a request's results under
+func endpoint(method, path string) string {
+	return method + " " + NormalizeRoute(path)
+}
+
+// routeStats returns the stats for the route, creating them if needed. r.Mutex must be held
+func (r *Results) routeStats(route string) *RouteStats {
+	if r.Routes == nil {
+		r.Routes = map[string]*RouteStats{}
+	}
+	stats, ok := r.Routes[route]
+	if !ok {
+		stats = &RouteStats{Latency: &Latency{}, ControlLatency: &Latency{}}
+		r.Routes[route] = stats
+	}
+	return stats
+}
+
+// updateRoute records the outcome of a request to the route. r.Mutex must be held
+func (r *Results) updateRoute(route string, hasDiff, isErr bool, latency, controlLatency time.Duration) {
+	stats := r.routeStats(route)
+	stats.Reqs++
+	if hasDiff {
+		stats.Diffs++
+	}
+	if isErr {
+		stats.Errors++
+	}
+	stats.Latency.Add(latency)
+	if controlLatency > 0 {
+		stats.ControlLatency.Add(controlLatency)
+	}
+}
+
+// SortedRoutes returns the routes with the most diffs first, then the most requests
+func (r *Results) SortedRoutes() []string {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	routes := []string{}
+	for route := range r.Routes {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := r.Routes[routes[i]], r.Routes[routes[j]]
+		if a.Diffs != b.Diffs {
+			return a.Diffs > b.Diffs
+		}
+		if a.Reqs != b.Reqs {
+			return a.Reqs > b.Reqs
+		}
+		return routes[i] < routes[j]
+	})
+	return routes
+}
@@ -0,0 +1,49 @@
+package science
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeRoute(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/":                                    "/",
+		"/v1/users/abc123":                     "/v1/users/:id",
+		"/v1/users/42/sections":                "/v1/users/:id/sections",
+		"/v2/schools/58f0fa2b9c1e2e0001a1b2c3": "/v2/schools/:id",
+		"/sections/0b4e7a0e-5fe1-4f4a-8a3a-3c3a6d5c0b1f": "/sections/:id",
+		"/v1/me":         "/v1/me",
+		"/oauth/tokens/": "/oauth/tokens/",
+		"/k3j4h5g6f7d8":  "/:id",
+		// Words with numbers in them aren't IDs
+		"/oauth2/token":             "/oauth2/token",
+		"/hashes/sha256":            "/hashes/sha256",
+		"/encode/base64":            "/encode/base64",
+		"/charsets/utf8mb4/collate": "/charsets/utf8mb4/collate",
+	} {
+		assert.Equal(t, expected, NormalizeRoute(path), path)
+	}
+}
+
+func TestUpdateRoute(t *testing.T) {
+	Res = Results{Mutex: &sync.Mutex{}}
+	Res.updateRoute(endpoint("GET", "/v1/users/1"), true, false, 10*time.Millisecond, 5*time.Millisecond)
+	Res.updateRoute(endpoint("GET", "/v1/users/2"), false, true, 30*time.Millisecond, 5*time.Millisecond)
+	Res.updateRoute(endpoint("GET", "/v1/me"), false, false, time.Millisecond, time.Millisecond)
+	Res.updateRoute(endpoint("GET", "/v1/me"), false, false, time.Millisecond, time.Millisecond)
+	Res.updateRoute(endpoint("GET", "/v1/me"), false, false, time.Millisecond, time.Millisecond)
+
+	assert.Equal(t, []string{"GET /v1/users/:id", "GET /v1/me"}, Res.SortedRoutes())
+	stats := Res.Routes["GET /v1/users/:id"]
+	assert.Equal(t, 2, stats.Reqs)
+	assert.Equal(t, 1, stats.Diffs)
+	assert.Equal(t, 1, stats.Errors)
+	assert.Equal(t, 20*time.Millisecond, stats.Latency.Mean())
+	assert.Equal(t, 30*time.Millisecond, stats.Latency.Max)
+	assert.Equal(t, 30*time.Millisecond, stats.Latency.Percentile(100))
+	assert.Equal(t, 10*time.Millisecond, stats.Latency.Percentile(0))
+	assert.Equal(t, 5*time.Millisecond, stats.ControlLatency.Mean())
+}
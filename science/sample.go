@@ -0,0 +1,97 @@
+package science
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Diff is a single request whose control and experiment responses differed
+type Diff struct {
+	Route          string
+	ControlCode    int
+	ExperimentCode int
+	Fields         []string
+	Request        string
+	Control        string
+	Experiment     string
+}
+
+// String formats the diff the way it is written to the diff log
+func (d Diff) String() string {
+	return fmt.Sprintf("=== diff ===\n%s\n---\n%s\n---\n%s\n============\n", d.Request, d.Control, d.Experiment)
+}
+
+// key is what diffs are capped by: the route and the status code pair
+func (d Diff) key() string {
+	return fmt.Sprintf("%s %d %d", d.Route, d.ControlCode, d.ExperimentCode)
+}
+
+// DiffSample is a uniform sample of the diffs seen for a route and status code pair
+type DiffSample struct {
+	Seen  int
+	Diffs []Diff
+}
+
+// reportSampleSize is how many diffs per route and status code pair we keep for reports
+// when the diff sample size isn't set
+const reportSampleSize = 5
+
+// recordDiff writes the diff to the diff log, or if sampleSize is set keeps it in a reservoir
+// sample to be written by FlushSamples. Either way a sample is kept for reports. r.Mutex must be held
+func (r *Results) recordDiff(d Diff, sampleSize int) {
+	size := sampleSize
+	if size <= 0 {
+		r.DiffLog.Write([]byte(d.String()))
+		size = reportSampleSize
+	}
+	if r.Samples == nil {
+		r.Samples = map[string]*DiffSample{}
+	}
+	sample, ok := r.Samples[d.key()]
+	if !ok {
+		sample = &DiffSample{}
+		r.Samples[d.key()] = sample
+	}
+	sample.Seen++
+	if len(sample.Diffs) < size {
+		sample.Diffs = append(sample.Diffs, d)
+		return
+	}
+	if sampleSize > 0 {
+		r.DroppedDiffs++
+	}
+	if i := rand.Intn(sample.Seen); i < size {
+		sample.Diffs[i] = d
+	}
+}
+
+// FlushSamples writes the sampled diffs to the diff log if sampleSize, the one diffs were
+// recorded with, is set. Otherwise every diff was already written
+func (r *Results) FlushSamples(sampleSize int) error {
+	if sampleSize <= 0 {
+		return nil
+	}
+	for _, d := range r.SampledDiffs() {
+		if _, err := r.DiffLog.Write([]byte(d.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SampledDiffs returns the sampled diffs grouped by route and status code pair
+func (r *Results) SampledDiffs() []Diff {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	keys := []string{}
+	for k := range r.Samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	diffs := []Diff{}
+	for _, k := range keys {
+		diffs = append(diffs, r.Samples[k].Diffs...)
+	}
+	return diffs
+}
@@ -0,0 +1,40 @@
+package science
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordDiffUnsampled(t *testing.T) {
+	Res = refreshResults()
+	Res.recordDiff(Diff{Route: "GET /", Request: "req", Control: "control", Experiment: "exp"}, 0)
+	assert.Equal(t, "=== diff ===\nreq\n---\ncontrol\n---\nexp\n============\n", Res.DiffLog.(*bytes.Buffer).String())
+	// A sample is still kept for reports
+	assert.Equal(t, 1, len(Res.SampledDiffs()))
+	assert.Nil(t, Res.FlushSamples(0))
+	assert.Equal(t, 1, strings.Count(Res.DiffLog.(*bytes.Buffer).String(), "=== diff ==="))
+}
+
+func TestRecordDiffSampled(t *testing.T) {
+	Res = refreshResults()
+
+	for i := 0; i < 100; i++ {
+		Res.recordDiff(Diff{Route: "GET /users/:id", ControlCode: 200, ExperimentCode: 500, Request: "users"}, 3)
+	}
+	Res.recordDiff(Diff{Route: "GET /users/:id", ControlCode: 200, ExperimentCode: 200, Request: "users"}, 3)
+	Res.recordDiff(Diff{Route: "GET /schools", ControlCode: 200, ExperimentCode: 200, Request: "schools"}, 3)
+
+	// Nothing is written until the samples are flushed
+	assert.Equal(t, 0, Res.DiffLog.(*bytes.Buffer).Len())
+	assert.Equal(t, 97, Res.DroppedDiffs)
+	assert.Equal(t, 100, Res.Samples["GET /users/:id 200 500"].Seen)
+	assert.Equal(t, 3, len(Res.Samples["GET /users/:id 200 500"].Diffs))
+
+	assert.Nil(t, Res.FlushSamples(3))
+	log := Res.DiffLog.(*bytes.Buffer).String()
+	assert.Equal(t, 5, strings.Count(log, "=== diff ==="))
+	assert.Equal(t, 1, strings.Count(log, "schools"))
+}
@@ -0,0 +1,168 @@
+package science
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+
+	"github.com/Clever/http-science/config"
+)
+
+// Selector picks requests for route coverage: identical requests are only forwarded once and each
+// normalized route gets at most a fixed number of requests. A nil Selector forwards every request
+type Selector struct {
+	dedup    bool
+	perRoute int
+
+	mutex  *sync.Mutex
+	seen   map[uint64]bool
+	routes map[string]int
+}
+
+// NewSelector returns a Selector for the config, or nil if it doesn't select anything
+func NewSelector(c config.Selection) *Selector {
+	if !c.Dedup && c.PerRoute <= 0 {
+		return nil
+	}
+	return &Selector{
+		dedup:    c.Dedup,
+		perRoute: c.PerRoute,
+		mutex:    &sync.Mutex{},
+		seen:     map[uint64]bool{},
+		routes:   map[string]int{},
+	}
+}
+
+// Restore counts the requests already forwarded to each route in the results towards its limit,
+// when resuming from a checkpoint. Which requests were forwarded isn't known, so they may be again
+func (s *Selector) Restore(res *Results) {
+	if s == nil {
+		return
+	}
+	res.Mutex.Lock()
+	defer res.Mutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for route, stats := range res.Routes {
+		s.routes[route] = stats.Reqs
+	}
+}
+
+// selection is a request the Selector picked, so it can be undone if the request isn't counted
+type selection struct {
+	// selector is nil if every request is forwarded
+	selector *Selector
+	route    string
+	hash     uint64
+}
+
+// Select returns true if the request should be forwarded, and counts it if so. The body is read and
+// restored if deduplicating
+func (s *Selector) Select(r *http.Request) (bool, error) {
+	sel, err := s.pick(r)
+	return sel != nil, err
+}
+
+// pick returns the request's selection if it should be forwarded, or nil if not
+func (s *Selector) pick(r *http.Request) (*selection, error) {
+	if s == nil {
+		return &selection{}, nil
+	}
+	var hash uint64
+	if s.dedup {
+		body, err := readBody(r)
+		if err != nil {
+			return nil, err
+		}
+		hash = requestHash(r, body)
+	}
+	route := endpoint(r.Method, r.URL.Path)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.dedup && s.seen[hash] {
+		return nil, nil
+	}
+	if s.perRoute > 0 && s.routes[route] >= s.perRoute {
+		return nil, nil
+	}
+	if s.dedup {
+		s.seen[hash] = true
+	}
+	s.routes[route]++
+	return &selection{selector: s, route: route, hash: hash}, nil
+}
+
+// undo gives back the request's place in its route's limit and forgets it was seen, so a request that
+// failed before being counted doesn't keep its route or a retry from being forwarded
+func (sel *selection) undo() {
+	s := sel.selector
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.dedup {
+		delete(s.seen, sel.hash)
+	}
+	s.routes[sel.route]--
+}
+
+// selectRequest returns true if the request should be forwarded, counting it as unselected if not.
+// The selection is kept with the reservation, and undone when it is released if the request wasn't counted
+func (r *Results) selectRequest(s *Selector, req *http.Request, reserved *reservation) bool {
+	sel, err := s.pick(req)
+	if err != nil {
+		config.KV.ErrorD("selecting-request-failed", logger.M{"err": err.Error()})
+	}
+	if sel == nil {
+		r.Mutex.Lock()
+		defer r.Mutex.Unlock()
+		r.Unselected++
+		return false
+	}
+	reserved.selection = sel
+	return true
+}
+
+// see counts a request to the route in the capture, whether or not it is forwarded. r.Mutex must not be held
+func (r *Results) see(route string) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if r.SeenRoutes == nil {
+		r.SeenRoutes = map[string]int{}
+	}
+	r.SeenRoutes[route]++
+}
+
+// SkippedRoute is a route that was in the capture but had no requests forwarded
+type SkippedRoute struct {
+	Route string
+	Seen  int
+}
+
+// Coverage returns the routes requests were forwarded to, and the routes that were seen but
+// had none forwarded, most seen first
+func (r *Results) Coverage() ([]string, []SkippedRoute) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	covered := []string{}
+	skipped := []SkippedRoute{}
+	for route, seen := range r.SeenRoutes {
+		if stats, ok := r.Routes[route]; ok && stats.Reqs > 0 {
+			covered = append(covered, route)
+		} else {
+			skipped = append(skipped, SkippedRoute{Route: route, Seen: seen})
+		}
+	}
+	sort.Strings(covered)
+	sort.Slice(skipped, func(i, j int) bool {
+		if skipped[i].Seen != skipped[j].Seen {
+			return skipped[i].Seen > skipped[j].Seen
+		}
+		return skipped[i].Route < skipped[j].Route
+	})
+	return covered, skipped
+}
@@ -0,0 +1,98 @@
+package science
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+)
+
+func TestSelector(t *testing.T) {
+	assert.Nil(t, NewSelector(config.Selection{}))
+
+	s := NewSelector(config.Selection{Dedup: true, PerRoute: 2})
+	selected := func(method, path, body string) bool {
+		ok, err := s.Select(httptest.NewRequest(method, path, strings.NewReader(body)))
+		assert.Nil(t, err)
+		return ok
+	}
+	assert.True(t, selected("GET", "/users/1", ""))
+	// Identical requests are only forwarded once
+	assert.False(t, selected("GET", "/users/1", ""))
+	assert.True(t, selected("POST", "/users", `{"name": "a"}`))
+	assert.False(t, selected("POST", "/users", `{"name": "a"}`))
+	assert.True(t, selected("POST", "/users", `{"name": "b"}`))
+	// Past the per route limit
+	assert.True(t, selected("GET", "/users/2", ""))
+	assert.False(t, selected("GET", "/users/3", ""))
+	assert.True(t, selected("GET", "/schools/1", ""))
+
+	// When resuming, requests already forwarded count towards the limit
+	s = NewSelector(config.Selection{PerRoute: 2})
+	s.Restore(&Results{Mutex: &sync.Mutex{}, Routes: map[string]*RouteStats{"GET /users/:id": {Reqs: 2}}})
+	assert.False(t, selected("GET", "/users/4", ""))
+}
+
+func TestSelectionUndo(t *testing.T) {
+	r := &Results{Mutex: &sync.Mutex{}}
+	s := NewSelector(config.Selection{Dedup: true, PerRoute: 1})
+	selected := func() bool {
+		reserved, ok := r.reserve()
+		assert.True(t, ok)
+		defer r.release(reserved)
+		return r.selectRequest(s, httptest.NewRequest("GET", "/users/1", nil), reserved)
+	}
+	counted := func() bool {
+		reserved, ok := r.reserve()
+		assert.True(t, ok)
+		defer r.release(reserved)
+		if !r.selectRequest(s, httptest.NewRequest("GET", "/users/1", nil), reserved) {
+			return false
+		}
+		r.Mutex.Lock()
+		defer r.Mutex.Unlock()
+		r.countReq(reserved)
+		return true
+	}
+
+	// A request that isn't counted, e.g. because rewriting it failed, gives back its place
+	assert.True(t, selected())
+	assert.True(t, counted())
+	assert.False(t, selected())
+	assert.Equal(t, 1, r.Unselected)
+}
+
+func TestExperimentCoverage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	e := NewExperiment(Options{
+		ControlURL:    server.URL,
+		ExperimentURL: server.URL,
+		Selector:      NewSelector(config.Selection{PerRoute: 1}),
+	})
+	for _, path := range []string{"/users/1", "/users/2", "/users/3", "/schools"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	assert.Equal(t, 2, e.Results.Reqs)
+	assert.Equal(t, 2, e.Results.Unselected)
+	covered, skipped := e.Results.Coverage()
+	assert.Equal(t, []string{"GET /schools", "GET /users/:id"}, covered)
+	assert.Equal(t, []SkippedRoute{}, skipped)
+
+	// Routes that are filtered out entirely are skipped
+	filter, err := NewFilter(config.Filter{QueryParams: []string{"fields"}})
+	assert.Nil(t, err)
+	e = NewExperiment(Options{ControlURL: server.URL, ExperimentURL: server.URL, Filter: filter})
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1?fields=id", nil))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/schools", nil))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/schools", nil))
+	covered, skipped = e.Results.Coverage()
+	assert.Equal(t, []string{"GET /users/:id"}, covered)
+	assert.Equal(t, []SkippedRoute{{Route: "GET /schools", Seen: 2}}, skipped)
+	assert.Equal(t, 2, e.Results.Filtered)
+}
@@ -0,0 +1,104 @@
+// Package sciencetest checks in unit tests that two http.Handlers respond to requests the same way,
+// using the same comparison http-science runs against deployed environments
+package sciencetest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Clever/http-science/science"
+)
+
+// AssertEquivalent runs each request through the control and experiment handlers and fails the test
+// with the fields that differ for every request they respond to differently. It returns true if
+// all the responses were the same
+func AssertEquivalent(t testing.TB, control, experiment http.Handler, requests []*http.Request) bool {
+	t.Helper()
+	return AssertEquivalentWith(t, science.Comparator{}, control, experiment, requests)
+}
+
+// AssertEquivalentWith is AssertEquivalent comparing responses with the comparator, e.g. to ignore
+// headers or body paths that are expected to differ
+func AssertEquivalentWith(t testing.TB, c science.Comparator, control, experiment http.Handler, requests []*http.Request) bool {
+	t.Helper()
+	equivalent := true
+	for _, r := range requests {
+		fields, err := Diff(c, control, experiment, r)
+		if err != nil {
+			t.Errorf("%s %s: %s", r.Method, r.URL.RequestURI(), err)
+			equivalent = false
+		} else if len(fields) > 0 {
+			t.Errorf("%s %s: responses differ in %s", r.Method, r.URL.RequestURI(), strings.Join(fields, ", "))
+			equivalent = false
+		}
+	}
+	return equivalent
+}
+
+// Diff runs the request through the control and experiment handlers and returns the fields
+// of their responses that differ. The request's body is restored, so it can be sent again
+func Diff(c science.Comparator, control, experiment http.Handler, r *http.Request) ([]string, error) {
+	body := []byte{}
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, fmt.Errorf("error reading request body: %s", err)
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	serve := func(h http.Handler) *http.Response {
+		dup := r.Clone(r.Context())
+		dup.Body = ioutil.NopCloser(bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, dup)
+		return rec.Result()
+	}
+	return c.Diff(r, serve(control), serve(experiment))
+}
+
+// ReadRequests parses raw HTTP requests written one after another, e.g. with httputil.DumpRequest
+func ReadRequests(r io.Reader) ([]*http.Request, error) {
+	buf := bufio.NewReader(r)
+	requests := []*http.Request{}
+	for {
+		if err := skipBlankLines(buf); err == io.EOF {
+			return requests, nil
+		} else if err != nil {
+			return nil, err
+		}
+		req, err := http.ReadRequest(buf)
+		if err != nil {
+			return nil, fmt.Errorf("error reading request %d: %s", len(requests)+1, err)
+		}
+		// The body has to be read before the next request
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading body of request %d: %s", len(requests)+1, err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.RequestURI = ""
+		requests = append(requests, req)
+	}
+}
+
+// skipBlankLines skips the blank lines between requests
+func skipBlankLines(buf *bufio.Reader) error {
+	for {
+		b, err := buf.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] != '\r' && b[0] != '\n' {
+			return nil
+		}
+		buf.ReadByte()
+	}
+}
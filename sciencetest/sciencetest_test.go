@@ -0,0 +1,94 @@
+package sciencetest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/science"
+)
+
+// recordingT records the failures of an assertion instead of failing the test
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func usersHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/users/1" {
+			fmt.Fprintf(w, `{"id": 1, "name": %q, "updated_at": %q}`, name, name)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+}
+
+func TestAssertEquivalent(t *testing.T) {
+	requests := []*http.Request{
+		httptest.NewRequest("GET", "/users/1", nil),
+		httptest.NewRequest("GET", "/users/2", nil),
+	}
+	assert.True(t, AssertEquivalent(t, usersHandler("ann"), usersHandler("ann"), requests))
+
+	rt := &recordingT{}
+	assert.False(t, AssertEquivalent(rt, usersHandler("ann"), usersHandler("bob"), requests))
+	assert.Equal(t, []string{"GET /users/1: responses differ in body.name, body.updated_at"}, rt.errors)
+
+	rt = &recordingT{}
+	c := science.Comparator{IgnoredBodyPaths: []string{"updated_at"}}
+	assert.False(t, AssertEquivalentWith(rt, c, usersHandler("ann"), usersHandler("bob"), requests))
+	assert.Equal(t, []string{"GET /users/1: responses differ in body.name"}, rt.errors)
+}
+
+func TestDiffSendsBodyToBoth(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	fields, err := Diff(science.Comparator{}, echo, echo, httptest.NewRequest("POST", "/echo", strings.NewReader("hello")))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, fields)
+	fields, err = Diff(science.Comparator{}, hello, echo, httptest.NewRequest("POST", "/echo", strings.NewReader("hello")))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, fields)
+
+	// The body is still there for the caller, e.g. to diff the request again
+	r := httptest.NewRequest("POST", "/echo", strings.NewReader("hello"))
+	_, err = Diff(science.Comparator{}, echo, echo, r)
+	assert.Nil(t, err)
+	fields, err = Diff(science.Comparator{}, hello, echo, r)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, fields)
+}
+
+func TestReadRequests(t *testing.T) {
+	raw := "GET /users/1 HTTP/1.1\r\nHost: example.com\r\n\r\n\n" +
+		"POST /users HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello\n"
+	requests, err := ReadRequests(strings.NewReader(raw))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, "/users/1", requests[0].URL.Path)
+	assert.Equal(t, "POST", requests[1].Method)
+
+	rt := &recordingT{}
+	assert.False(t, AssertEquivalent(rt, usersHandler("ann"), usersHandler("bob"), requests))
+	assert.Equal(t, 1, len(rt.errors))
+
+	_, err = ReadRequests(strings.NewReader("not a request\r\n\r\n"))
+	assert.NotNil(t, err)
+}
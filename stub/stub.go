@@ -0,0 +1,295 @@
+package stub
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/Clever/kayvee-go.v3/logger"
+	"gopkg.in/Clever/pathio.v3"
+
+	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/gor"
+	"github.com/Clever/http-science/har"
+)
+
+// Server serves canned and recorded responses to the requests targets make to their downstream
+// services, so replaying doesn't reach the real ones. The first canned stub that matches a request
+// is served, or failing that its recorded response. Requests that match none get a 502
+type Server struct {
+	stubs []stub
+	// recorded are the responses in each stub file, in the order of the files
+	recorded []*recording
+
+	mutex     *sync.Mutex
+	served    int
+	unmatched int
+}
+
+// stub is a response and the requests it is served to. Empty fields match anything
+type stub struct {
+	method string
+	host   string
+	url    *regexp.Regexp
+	body   *regexp.Regexp
+	status int
+	header http.Header
+	// response is the body of the response
+	response []byte
+}
+
+// New returns a Server for the payload's stubs followed by the recorded responses in its stub files
+func New(payload *config.Payload) (*Server, error) {
+	s := &Server{mutex: &sync.Mutex{}}
+	for i, c := range payload.Stubs {
+		st, err := canned(c)
+		if err != nil {
+			return nil, fmt.Errorf("error in stubs[%d]: %s", i, err)
+		}
+		s.stubs = append(s.stubs, st)
+	}
+	for _, loc := range payload.StubFiles {
+		recorded, err := load(loc)
+		if err != nil {
+			return nil, fmt.Errorf("error loading stub file %s: %s", loc, err)
+		}
+		if len(recorded.fallback) == 0 {
+			// e.g. capture files written by record, which don't track responses
+			return nil, fmt.Errorf("stub file %s has no recorded responses", loc)
+		}
+		s.recorded = append(s.recorded, recorded)
+	}
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading request: %s", err), http.StatusBadRequest)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if st, ok := s.match(r, body); ok {
+		s.count(&s.served)
+		for name, values := range st.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(st.status)
+		w.Write(st.response)
+		return
+	}
+
+	s.count(&s.unmatched)
+	// Only the request line is logged, the headers and body can hold credentials
+	config.KV.ErrorD("no-stub-matched", logger.M{"method": r.Method, "host": r.Host, "uri": r.URL.RequestURI()})
+	http.Error(w, "http-science: no stub matches the request", http.StatusBadGateway)
+}
+
+// Stats returns how many requests were served a stub and how many matched none
+func (s *Server) Stats() (served, unmatched int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.served, s.unmatched
+}
+
+func (s *Server) count(n *int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	*n++
+}
+
+// match returns the first canned stub that matches the request, or failing that the first recorded one
+func (s *Server) match(r *http.Request, body []byte) (stub, bool) {
+	for _, st := range s.stubs {
+		if st.matches(r, body) {
+			return st, true
+		}
+	}
+	for _, rec := range s.recorded {
+		if st, ok := rec.match(r.Method, r.URL.RequestURI(), body); ok {
+			return st, true
+		}
+	}
+	return stub{}, false
+}
+
+func (st stub) matches(r *http.Request, body []byte) bool {
+	return (st.method == "" || strings.EqualFold(st.method, r.Method)) &&
+		(st.host == "" || strings.EqualFold(st.host, r.Host)) &&
+		(st.url == nil || st.url.MatchString(r.URL.RequestURI())) &&
+		(st.body == nil || st.body.Match(body))
+}
+
+// canned builds the stub of a stub in the payload
+func canned(c config.Stub) (stub, error) {
+	st := stub{method: c.Method, host: c.Host, status: c.Status, header: http.Header{}, response: []byte(c.Body)}
+	var err error
+	if c.URLRegex != "" {
+		if st.url, err = regexp.Compile(c.URLRegex); err != nil {
+			return stub{}, fmt.Errorf("url_regex %q is not a valid regex: %s", c.URLRegex, err)
+		}
+	}
+	if c.BodyRegex != "" {
+		if st.body, err = regexp.Compile(c.BodyRegex); err != nil {
+			return stub{}, fmt.Errorf("body_regex %q is not a valid regex: %s", c.BodyRegex, err)
+		}
+	}
+	if st.status == 0 {
+		st.status = http.StatusOK
+	}
+	for name, value := range c.Headers {
+		st.header.Set(name, value)
+	}
+	return st, nil
+}
+
+// load reads the recorded requests and responses in a HAR, or a gor capture file that tracked responses
+func load(loc string) (*recording, error) {
+	reader, err := pathio.Reader(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	// Capture files are usually gzipped
+	if bytes.HasPrefix(buf, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		if buf, err = ioutil.ReadAll(gz); err != nil {
+			return nil, err
+		}
+	}
+	if strings.HasSuffix(loc, ".har") {
+		h, err := har.Read(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		return fromHAR(h)
+	}
+	payloads, err := gor.ReadPayloads(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	return fromCapture(payloads)
+}
+
+// fromCapture pairs the requests and responses in a capture file by ID
+func fromCapture(payloads []gor.Payload) (*recording, error) {
+	requests := map[string]*http.Request{}
+	bodies := map[string][]byte{}
+	rec := newRecording()
+	for i, p := range payloads {
+		switch p.Type {
+		case gor.RequestPayload:
+			r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(p.Data)))
+			if err != nil {
+				return nil, fmt.Errorf("error reading request %d: %s", i, err)
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return nil, fmt.Errorf("error reading request %d: %s", i, err)
+			}
+			requests[p.ID], bodies[p.ID] = r, body
+		case gor.ResponsePayload:
+			r, ok := requests[p.ID]
+			if !ok {
+				continue
+			}
+			res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(p.Data)), r)
+			if err != nil {
+				return nil, fmt.Errorf("error reading response %d: %s", i, err)
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				return nil, fmt.Errorf("error reading response %d: %s", i, err)
+			}
+			rec.add(r.Method, r.URL.RequestURI(), bodies[p.ID], res.StatusCode, res.Header, body)
+		}
+	}
+	return rec, nil
+}
+
+// fromHAR reads the requests and responses of the HAR's entries
+func fromHAR(h *har.HAR) (*recording, error) {
+	rec := newRecording()
+	for i, e := range h.Log.Entries {
+		r, err := e.HTTPRequest()
+		if err != nil {
+			return nil, fmt.Errorf("error building request of entry %d: %s", i, err)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		header := http.Header{}
+		for _, nv := range e.Response.Headers {
+			header.Add(nv.Name, nv.Value)
+		}
+		// The content of a HAR is decoded
+		header.Del("Content-Encoding")
+		rec.add(r.Method, r.URL.RequestURI(), body, e.Response.Status, header, []byte(e.Response.Content.Text))
+	}
+	return rec, nil
+}
+
+// recording holds recorded requests and responses, indexed so a stub file of any size is matched in
+// constant time. A request is served the response to the first recorded request with the same method,
+// path, query and body, or failing that the first with the same method, path and query
+type recording struct {
+	// exact is keyed by exactKey, fallback by fallbackKey
+	exact    map[string]stub
+	fallback map[string]stub
+}
+
+func newRecording() *recording {
+	return &recording{exact: map[string]stub{}, fallback: map[string]stub{}}
+}
+
+// fallbackKey is the method, path and query of a request. Methods are matched case insensitively like
+// in canned stubs
+func fallbackKey(method, uri string) string {
+	return strings.ToUpper(method) + " " + uri
+}
+
+// exactKey is the fallback key and body of a request. A request URI has no spaces, so it can't be
+// confused with the body
+func exactKey(method, uri string, body []byte) string {
+	return fallbackKey(method, uri) + " " + string(body)
+}
+
+func (rec *recording) add(method, uri string, body []byte, status int, header http.Header, response []byte) {
+	// Requests that got no response, like blocked ones in a browser HAR, have nothing to serve
+	if status < 100 {
+		return
+	}
+	// The server sets these for the body it writes
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	st := stub{method: method, status: status, header: header, response: response}
+	if _, ok := rec.fallback[fallbackKey(method, uri)]; !ok {
+		rec.fallback[fallbackKey(method, uri)] = st
+	}
+	if _, ok := rec.exact[exactKey(method, uri, body)]; !ok {
+		rec.exact[exactKey(method, uri, body)] = st
+	}
+}
+
+// match returns the recorded response to the request
+func (rec *recording) match(method, uri string, body []byte) (stub, bool) {
+	if st, ok := rec.exact[exactKey(method, uri, body)]; ok {
+		return st, true
+	}
+	st, ok := rec.fallback[fallbackKey(method, uri)]
+	return st, ok
+}
@@ -0,0 +1,88 @@
+package stub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/gor"
+)
+
+// capture is a capture file with tracked responses, written the way gor does
+const capture = "1 a 1464736200000000000\nGET /v1/users/1 HTTP/1.1\r\nHost: users.example.com\r\n\r\n" + gor.PayloadSeparator +
+	"1 b 1464736201000000000\nPOST /v1/users HTTP/1.1\r\nHost: users.example.com\r\nContent-Length: 12\r\n\r\n{\"name\":\"a\"}" + gor.PayloadSeparator +
+	"1 c 1464736202000000000\nPOST /v1/users HTTP/1.1\r\nHost: users.example.com\r\nContent-Length: 12\r\n\r\n{\"name\":\"b\"}" + gor.PayloadSeparator +
+	"2 b 1464736201000000000 1000\nHTTP/1.1 201 Created\r\nContent-Length: 8\r\n\r\n{\"id\":2}" + gor.PayloadSeparator +
+	"2 a 1464736200000000000 1000\nHTTP/1.1 200 OK\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n8\r\n{\"id\":1}\r\n0\r\n\r\n" + gor.PayloadSeparator +
+	"2 c 1464736202000000000 1000\nHTTP/1.1 201 Created\r\nContent-Length: 8\r\n\r\n{\"id\":3}" + gor.PayloadSeparator
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stub")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "capture.gz")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(capture))
+	gz.Close()
+	assert.Nil(t, ioutil.WriteFile(file, buf.Bytes(), 0644))
+
+	s, err := New(&config.Payload{
+		Stubs: []config.Stub{
+			{Method: "GET", URLRegex: "^/v1/users/42$", Body: "{}", Headers: map[string]string{"X-Stub": "1"}},
+			{Host: "billing.example.com", BodyRegex: `"amount"`, Status: 402},
+		},
+		StubFiles: config.StringList{file},
+	})
+	assert.Nil(t, err)
+
+	send := func(method, host, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Host = host
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// Canned stubs come first
+	w := send("GET", "localhost", "/v1/users/42", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "1", w.Header().Get("X-Stub"))
+	assert.Equal(t, "{}", w.Body.String())
+	assert.Equal(t, 402, send("POST", "billing.example.com", "/charges", `{"amount": 1}`).Code)
+
+	// Recorded responses match the method, path, query and body
+	w = send("GET", "localhost", "/v1/users/1", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"id":1}`, w.Body.String())
+	assert.Equal(t, `{"id":3}`, send("POST", "localhost", "/v1/users", `{"name":"b"}`).Body.String())
+	// Or failing the body, the first request to the same URL
+	assert.Equal(t, `{"id":2}`, send("POST", "localhost", "/v1/users", `{"name":"c"}`).Body.String())
+
+	assert.Equal(t, http.StatusBadGateway, send("GET", "localhost", "/v1/users/1?fields=name", "").Code)
+	served, unmatched := s.Stats()
+	assert.Equal(t, 5, served)
+	assert.Equal(t, 1, unmatched)
+}
+
+func TestServerStubFileWithoutResponses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stub")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "capture")
+	requests := "1 a 1464736200000000000\nGET /v1/users/1 HTTP/1.1\r\nHost: users.example.com\r\n\r\n" + gor.PayloadSeparator
+	assert.Nil(t, ioutil.WriteFile(file, []byte(requests), 0644))
+
+	_, err = New(&config.Payload{StubFiles: config.StringList{file}})
+	assert.EqualError(t, err, "stub file "+file+" has no recorded responses")
+}
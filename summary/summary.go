@@ -0,0 +1,220 @@
+package summary
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"gopkg.in/Clever/pathio.v3"
+
+	"github.com/Clever/http-science/config"
+	"github.com/Clever/http-science/science"
+)
+
+// Version is the version of the summary format. Bump it on changes that break consumers
+const Version = 1
+
+// Reasons the job finished
+const (
+	ExitReqsReached = "reqs_reached"
+	ExitOutOfFiles  = "out_of_files"
+	ExitInterrupted = "interrupted"
+)
+
+// Summary is the machine-readable result of a run
+type Summary struct {
+	Version      int             `json:"version"`
+	Payload      *config.Payload `json:"payload"`
+	StartTime    time.Time       `json:"start_time"`
+	EndTime      time.Time       `json:"end_time"`
+	ExitReason   string          `json:"exit_reason"`
+	Partial      bool            `json:"partial"`
+	Reqs         int             `json:"reqs"`
+	Received     int             `json:"received"`
+	Diffs        int             `json:"diffs"`
+	DroppedDiffs int             `json:"dropped_diffs"`
+	// DryRun is set if writes were only sent to the experiment or dry_run_url, DryRunWrites counts them
+	DryRun       bool `json:"dry_run"`
+	DryRunWrites int  `json:"dry_run_writes"`
+	// Filtered counts the requests the filter didn't forward, Unselected the ones the selection didn't
+	Filtered   int `json:"filtered"`
+	Unselected int `json:"unselected"`
+	// Codes is the status code matrix of every request, DiffCodes only of the requests with diffs
+	Codes          []CodePair          `json:"codes"`
+	DiffCodes      []CodePair          `json:"diff_codes"`
+	Errors         map[string]int      `json:"errors"`
+	Latency        LatencyStats        `json:"latency"`
+	ControlLatency LatencyStats        `json:"control_latency"`
+	Routes         []Route             `json:"routes"`
+	Coverage       Coverage            `json:"coverage"`
+	Noise          map[string]int      `json:"noise"`
+	LearnedNoise   science.NoiseReport `json:"learned_noise"`
+	Verdict        Verdict             `json:"verdict"`
+}
+
+// CodePair is how many requests got a status code from the control and from the experiment.
+// For load tests only the experiment code is set
+type CodePair struct {
+	Control    int `json:"control"`
+	Experiment int `json:"experiment"`
+	Count      int `json:"count"`
+}
+
+// Coverage is which of the routes in the capture had requests replayed. Skipped routes were seen
+// but had none replayed, e.g. because of filters or the concurrency limit
+type Coverage struct {
+	Covered []string       `json:"covered"`
+	Skipped []SkippedRoute `json:"skipped"`
+}
+
+// SkippedRoute is a route that was in the capture but wasn't replayed, and how often it was seen
+type SkippedRoute struct {
+	Route string `json:"route"`
+	Seen  int    `json:"seen"`
+}
+
+// LatencyStats summarizes response times in milliseconds
+type LatencyStats struct {
+	Count  int     `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+// Route is the results for a normalized route
+type Route struct {
+	Route          string       `json:"route"`
+	Reqs           int          `json:"reqs"`
+	Diffs          int          `json:"diffs"`
+	Errors         int          `json:"errors"`
+	DiffRate       float64      `json:"diff_rate"`
+	ErrorRate      float64      `json:"error_rate"`
+	Latency        LatencyStats `json:"latency"`
+	ControlLatency LatencyStats `json:"control_latency"`
+}
+
+// Loc returns where the summary is written: summary_loc if set, otherwise next to the diff log
+func Loc(payload *config.Payload) string {
+	if payload.SummaryLoc != "" {
+		return payload.SummaryLoc
+	}
+	if payload.DiffLoc != "" {
+		return payload.DiffLoc + ".summary.json"
+	}
+	return ""
+}
+
+// Build summarizes the results of a run
+func Build(payload *config.Payload, res *science.Results, start, end time.Time, reason string) *Summary {
+	routes := res.SortedRoutes()
+	learned := res.LearnedNoise()
+	covered, skipped := res.Coverage()
+
+	res.Mutex.Lock()
+	defer res.Mutex.Unlock()
+	s := &Summary{
+		Version:      Version,
+		Payload:      payload.Redacted(),
+		StartTime:    start,
+		EndTime:      end,
+		ExitReason:   reason,
+		Partial:      reason == ExitInterrupted,
+		Reqs:         res.Reqs,
+		Received:     res.Received,
+		Diffs:        res.Diffs,
+		DroppedDiffs: res.DroppedDiffs,
+		DryRun:       payload.DryRun,
+		DryRunWrites: res.DryRunWrites,
+		Filtered:     res.Filtered,
+		Unselected:   res.Unselected,
+		Coverage:     Coverage{Covered: covered, Skipped: []SkippedRoute{}},
+		Codes:        codePairs(res.AllCodes),
+		DiffCodes:    codePairs(res.Codes),
+		Errors:       map[string]int{},
+		Routes:       []Route{},
+		Noise:        map[string]int{},
+		LearnedNoise: learned,
+	}
+	for _, r := range skipped {
+		s.Coverage.Skipped = append(s.Coverage.Skipped, SkippedRoute{Route: r.Route, Seen: r.Seen})
+	}
+	for k, v := range res.Errors {
+		s.Errors[k] = v
+	}
+	for k, v := range res.Noise {
+		s.Noise[k] = v
+	}
+
+	latency, controlLatency := &science.Latency{}, &science.Latency{}
+	for _, name := range routes {
+		r := res.Routes[name]
+		latency.Merge(r.Latency)
+		controlLatency.Merge(r.ControlLatency)
+		s.Routes = append(s.Routes, Route{
+			Route:          name,
+			Reqs:           r.Reqs,
+			Diffs:          r.Diffs,
+			Errors:         r.Errors,
+			DiffRate:       rate(r.Diffs, r.Reqs),
+			ErrorRate:      rate(r.Errors, r.Reqs),
+			Latency:        latencyStats(r.Latency),
+			ControlLatency: latencyStats(r.ControlLatency),
+		})
+	}
+	s.Latency = latencyStats(latency)
+	s.ControlLatency = latencyStats(controlLatency)
+	return s
+}
+
+// Write writes the summary as JSON to loc
+func Write(loc string, s *Summary) error {
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return pathio.Write(loc, buf)
+}
+
+// codePairs flattens a status code matrix keyed by experiment code then control code
+func codePairs(codes map[int]map[int]int) []CodePair {
+	pairs := []CodePair{}
+	for exp, controls := range codes {
+		for control, count := range controls {
+			pairs = append(pairs, CodePair{Control: control, Experiment: exp, Count: count})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Control != pairs[j].Control {
+			return pairs[i].Control < pairs[j].Control
+		}
+		return pairs[i].Experiment < pairs[j].Experiment
+	})
+	return pairs
+}
+
+func latencyStats(l *science.Latency) LatencyStats {
+	if l == nil {
+		return LatencyStats{}
+	}
+	return LatencyStats{
+		Count:  l.Count,
+		MeanMs: ms(l.Mean()),
+		P50Ms:  ms(l.Percentile(50)),
+		P90Ms:  ms(l.Percentile(90)),
+		P99Ms:  ms(l.Percentile(99)),
+		MaxMs:  ms(l.Max),
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
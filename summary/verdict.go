@@ -0,0 +1,105 @@
+package summary
+
+import (
+	"fmt"
+
+	"github.com/Clever/http-science/config"
+)
+
+// Verdict results
+const (
+	VerdictPass       = "pass"
+	VerdictFail       = "fail"
+	VerdictIncomplete = "incomplete"
+)
+
+// Verdict is whether the run met the thresholds in the payload, and the code the process exits with
+type Verdict struct {
+	Result   string   `json:"result"`
+	ExitCode int      `json:"exit_code"`
+	Failures []string `json:"failures"`
+}
+
+// Evaluate checks the summary against the thresholds and sets its verdict. A run that replayed no
+// requests fails. An interrupted run, or one that ran out of files before replaying the requests
+// asked for, is incomplete no matter what the thresholds say
+func Evaluate(s *Summary, t config.Thresholds) Verdict {
+	v := Verdict{Result: VerdictPass, ExitCode: config.ExitPass, Failures: []string{}}
+	incomplete := s.Partial
+	if incomplete {
+		v.Result, v.ExitCode = VerdictIncomplete, config.ExitInterrupted
+	}
+	if s.ExitReason == ExitOutOfFiles && s.Payload != nil && s.Reqs < s.Payload.Reqs {
+		incomplete = true
+		v.Failures = append(v.Failures, fmt.Sprintf("only %d of %d reqs were replayed before running out of files", s.Reqs, s.Payload.Reqs))
+		v.Result, v.ExitCode = VerdictIncomplete, config.ExitOutOfFiles
+	}
+	if s.Reqs == 0 && !s.Partial {
+		// Nothing was tested, which mustn't pass a gate. Fail rather than look like a retryable interruption
+		v.Failures = append(v.Failures, "no requests were replayed")
+		v.Result, v.ExitCode = VerdictFail, config.ExitThresholdsFailed
+		s.Verdict = v
+		return v
+	}
+
+	reqs, errors := 0, 0
+	for _, r := range s.Routes {
+		reqs += r.Reqs
+		errors += r.Errors
+		if t.MaxDiffsPerRoute != nil && r.Diffs > *t.MaxDiffsPerRoute {
+			v.Failures = append(v.Failures, fmt.Sprintf("%s had %d diffs, max_diffs_per_route is %d", r.Route, r.Diffs, *t.MaxDiffsPerRoute))
+		}
+	}
+	if t.MaxDiffRate != nil && rate(s.Diffs, s.Reqs) > *t.MaxDiffRate {
+		v.Failures = append(v.Failures, fmt.Sprintf("diff rate was %.4f, max_diff_rate is %.4f", rate(s.Diffs, s.Reqs), *t.MaxDiffRate))
+	}
+	if t.MaxErrorRate != nil && rate(errors, reqs) > *t.MaxErrorRate {
+		v.Failures = append(v.Failures, fmt.Sprintf("error rate was %.4f, max_error_rate is %.4f", rate(errors, reqs), *t.MaxErrorRate))
+	}
+	if t.MaxP99LatencyRegression != nil && s.ControlLatency.P99Ms > 0 {
+		regression := s.Latency.P99Ms/s.ControlLatency.P99Ms - 1
+		if regression > *t.MaxP99LatencyRegression {
+			v.Failures = append(v.Failures, fmt.Sprintf("p99 latency regressed by %.4f (%.1fms vs %.1fms), max_p99_latency_regression is %.4f",
+				regression, s.Latency.P99Ms, s.ControlLatency.P99Ms, *t.MaxP99LatencyRegression))
+		}
+	}
+	if t.MaxAuthFailureRate != nil {
+		v.Failures = append(v.Failures, authFailures(s, *t.MaxAuthFailureRate)...)
+	}
+
+	if len(v.Failures) > 0 && !incomplete {
+		v.Result, v.ExitCode = VerdictFail, config.ExitThresholdsFailed
+	}
+	s.Verdict = v
+	return v
+}
+
+// authFailures flags a target whose responses were mostly 401 or 403, where diffs say little about
+// the change. Load tests only have the experiment code
+func authFailures(s *Summary, max float64) []string {
+	failures := []string{}
+	total, control, experiment := 0, 0, 0
+	for _, c := range s.Codes {
+		total += c.Count
+		if isAuthFailure(c.Control) {
+			control += c.Count
+		}
+		if isAuthFailure(c.Experiment) {
+			experiment += c.Count
+		}
+	}
+	for _, target := range []struct {
+		name     string
+		failures int
+	}{{"control", control}, {"experiment", experiment}} {
+		if rate(target.failures, total) > max {
+			failures = append(failures, fmt.Sprintf("%s auth failure rate (401 or 403) was %.4f, max_auth_failure_rate is %.4f. Check the auth config",
+				target.name, rate(target.failures, total), max))
+		}
+	}
+	return failures
+}
+
+func isAuthFailure(code int) bool {
+	return code == 401 || code == 403
+}
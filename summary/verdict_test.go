@@ -0,0 +1,98 @@
+package summary
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+)
+
+func TestEvaluate(t *testing.T) {
+	maxDiffRate, maxErrorRate, maxRegression := 0.05, 0.1, 0.2
+	maxDiffsPerRoute := 3
+	thresholds := config.Thresholds{
+		MaxDiffRate:             &maxDiffRate,
+		MaxDiffsPerRoute:        &maxDiffsPerRoute,
+		MaxErrorRate:            &maxErrorRate,
+		MaxP99LatencyRegression: &maxRegression,
+	}
+	passing := func() *Summary {
+		return &Summary{
+			Reqs:  100,
+			Diffs: 5,
+			Routes: []Route{
+				{Route: "GET /a", Reqs: 50, Diffs: 3, Errors: 5},
+				{Route: "GET /b", Reqs: 50, Diffs: 2, Errors: 5},
+			},
+			Latency:        LatencyStats{P99Ms: 120},
+			ControlLatency: LatencyStats{P99Ms: 100},
+		}
+	}
+
+	s := passing()
+	assert.Equal(t, Verdict{Result: VerdictPass, ExitCode: config.ExitPass, Failures: []string{}}, Evaluate(s, thresholds))
+	assert.Equal(t, VerdictPass, s.Verdict.Result)
+
+	// No thresholds always passes
+	s = passing()
+	s.Diffs = 100
+	assert.Equal(t, VerdictPass, Evaluate(s, config.Thresholds{}).Result)
+
+	s = passing()
+	s.Diffs = 6
+	s.Routes[0].Diffs = 4
+	s.Routes[0].Errors = 20
+	s.Latency.P99Ms = 130
+	v := Evaluate(s, thresholds)
+	assert.Equal(t, VerdictFail, v.Result)
+	assert.Equal(t, config.ExitThresholdsFailed, v.ExitCode)
+	assert.Equal(t, 4, len(v.Failures))
+
+	// Interrupted runs are incomplete even if they fail thresholds
+	s.Partial = true
+	v = Evaluate(s, thresholds)
+	assert.Equal(t, VerdictIncomplete, v.Result)
+	assert.Equal(t, config.ExitInterrupted, v.ExitCode)
+}
+
+func TestEvaluateIncomplete(t *testing.T) {
+	// Nothing replayed fails even without thresholds
+	v := Evaluate(&Summary{Payload: &config.Payload{Reqs: 1000}, ExitReason: ExitOutOfFiles}, config.Thresholds{})
+	assert.Equal(t, Verdict{Result: VerdictFail, ExitCode: config.ExitThresholdsFailed, Failures: []string{
+		"only 0 of 1000 reqs were replayed before running out of files",
+		"no requests were replayed",
+	}}, v)
+
+	// Running out of files short of reqs is incomplete
+	v = Evaluate(&Summary{Payload: &config.Payload{Reqs: 1000}, ExitReason: ExitOutOfFiles, Reqs: 10}, config.Thresholds{})
+	assert.Equal(t, Verdict{Result: VerdictIncomplete, ExitCode: config.ExitOutOfFiles, Failures: []string{
+		"only 10 of 1000 reqs were replayed before running out of files",
+	}}, v)
+	v = Evaluate(&Summary{Payload: &config.Payload{Reqs: 10}, ExitReason: ExitOutOfFiles, Reqs: 10}, config.Thresholds{})
+	assert.Equal(t, VerdictPass, v.Result)
+}
+
+func TestEvaluateAuthFailures(t *testing.T) {
+	maxAuthFailureRate := 0.5
+	thresholds := config.Thresholds{MaxAuthFailureRate: &maxAuthFailureRate}
+
+	// Both sides returning 401 are equal, but the run says nothing about the change
+	s := &Summary{Reqs: 10, Codes: []CodePair{
+		{Control: 200, Experiment: 200, Count: 4},
+		{Control: 401, Experiment: 401, Count: 6},
+	}}
+	v := Evaluate(s, thresholds)
+	assert.Equal(t, VerdictFail, v.Result)
+	assert.Equal(t, []string{
+		"control auth failure rate (401 or 403) was 0.6000, max_auth_failure_rate is 0.5000. Check the auth config",
+		"experiment auth failure rate (401 or 403) was 0.6000, max_auth_failure_rate is 0.5000. Check the auth config",
+	}, v.Failures)
+
+	// Load tests only have experiment codes
+	s = &Summary{Reqs: 10, Codes: []CodePair{
+		{Experiment: 200, Count: 5},
+		{Experiment: 403, Count: 5},
+	}}
+	assert.Equal(t, VerdictPass, Evaluate(s, thresholds).Result)
+}
@@ -1,56 +1,85 @@
 package validate
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"regexp"
+	"strings"
 
 	"github.com/Clever/http-science/config"
 )
 
-// Payload validates the payload
+// Payload validates the payload, returning every problem with it at once
 func Payload(payload *config.Payload) (*config.Payload, error) {
+	errs := []error{}
 	if payload.ServiceName == "" {
-		return nil, fmt.Errorf("Payload must contain 'service_name'")
+		errs = append(errs, fmt.Errorf("Payload must contain 'service_name'"))
 	}
 
 	// Must have job_type and the appropriate urls
 	switch payload.JobType {
 	case "load":
-		if payload.LoadEnv == "" {
-			return nil, fmt.Errorf("Payload must contain 'load_env' if job_type is load")
+		if payload.LoadEnv == "" && payload.LoadURL == "" {
+			errs = append(errs, fmt.Errorf("Payload must contain 'load_env' or 'load_url' if job_type is load"))
 		}
 		if payload.Speed != 0 && payload.Concurrency != 0 {
-			return nil, fmt.Errorf("Payload can't contain both speed an concurrency")
+			errs = append(errs, fmt.Errorf("Payload can't contain both speed an concurrency"))
 		}
-		podID := ""
-		if payload.PodID != "" {
-			podID = fmt.Sprintf("--%s", payload.PodID)
+		if payload.LoadURL == "" {
+			payload.LoadURL = targetURL(payload, payload.LoadEnv, "443")
 		}
-
-		payload.LoadURL = fmt.Sprintf("https://%s--%s%s.int.clever.com:443", payload.LoadEnv, payload.ServiceName, podID)
 	case "correctness":
 		port := "443"
 		if payload.Port != "" {
 			port = payload.Port
 		}
-		if payload.ExperimentEnv == "" || payload.ControlEnv == "" {
-			return nil, fmt.Errorf("Payload must contain 'experiment_env' and 'control_env' if job_type is correctness")
+		if (payload.ExperimentEnv == "" && payload.ExperimentURL == "") || (payload.ControlEnv == "" && payload.ControlURL == "") {
+			errs = append(errs, fmt.Errorf("Payload must contain 'experiment_env' or 'experiment_url', and 'control_env' or 'control_url' if job_type is correctness"))
 		}
 		if payload.DiffLoc == "" {
-			return nil, fmt.Errorf("Payload must contain 'diff_loc' if job_type is correctness")
+			errs = append(errs, fmt.Errorf("Payload must contain 'diff_loc' if job_type is correctness"))
 		}
 		if payload.Speed != 0 {
-			return nil, fmt.Errorf("Payload can't contain speed if job_type is correctness. Use concurrency")
+			errs = append(errs, fmt.Errorf("Payload can't contain speed if job_type is correctness. Use concurrency"))
+		}
+		if payload.DiffSampleSize < 0 {
+			errs = append(errs, fmt.Errorf("diff_sample_size can't be negative, got %d", payload.DiffSampleSize))
+		}
+		if payload.DiffUploadInterval == 0 {
+			payload.DiffUploadInterval = 60
+		} else if payload.DiffUploadInterval < 0 {
+			errs = append(errs, fmt.Errorf("diff_upload_interval can't be negative, got %d", payload.DiffUploadInterval))
+		}
+		if payload.DiffChunkBytes == 0 {
+			payload.DiffChunkBytes = 64 * 1024 * 1024
+		} else if payload.DiffChunkBytes < 0 {
+			errs = append(errs, fmt.Errorf("diff_chunk_bytes can't be negative, got %d", payload.DiffChunkBytes))
+		}
+		if payload.ControlURL == "" {
+			payload.ControlURL = targetURL(payload, payload.ControlEnv, port)
+		}
+		if payload.ExperimentURL == "" {
+			payload.ExperimentURL = targetURL(payload, payload.ExperimentEnv, port)
+		}
+		if payload.Control2URL == "" && payload.Control2Env != "" {
+			payload.Control2URL = targetURL(payload, payload.Control2Env, port)
 		}
-		podID := ""
-		if payload.PodID != "" {
-			podID = fmt.Sprintf("--%s", payload.PodID)
+	case "record":
+		if payload.RecordURL == "" {
+			errs = append(errs, fmt.Errorf("Payload must contain 'record_url' if job_type is record"))
+		}
+		if payload.RecordSampleRate == 0 {
+			payload.RecordSampleRate = 1
+		} else if payload.RecordSampleRate < 0 || payload.RecordSampleRate > 1 {
+			errs = append(errs, fmt.Errorf("record_sample_rate must be between 0 and 1, got %v", payload.RecordSampleRate))
+		}
+		if payload.ListenAddr == "" {
+			payload.ListenAddr = ":8080"
 		}
-		payload.ControlURL = fmt.Sprintf("https://%s--%s%s.int.clever.com:%s", payload.ControlEnv, payload.ServiceName, podID, port)
-		payload.ExperimentURL = fmt.Sprintf("https://%s--%s%s.int.clever.com:%s", payload.ExperimentEnv, payload.ServiceName, podID, port)
 	default:
-		return nil, fmt.Errorf("Payload.job_type must be 'load' or 'correctness', got %s", payload.JobType)
+		errs = append(errs, fmt.Errorf("Payload.job_type must be 'load', 'correctness' or 'record', got %s", payload.JobType))
 	}
 
 	// Set default speed
@@ -64,15 +93,76 @@ func Payload(payload *config.Payload) (*config.Payload, error) {
 	if payload.Reqs == 0 {
 		payload.Reqs = 1000
 	}
-	// Only replay GETs unless specified
-	if payload.Methods == "" {
-		payload.Methods = "GET"
+	// Only replay GETs unless specified. Every method is recorded unless specified
+	if len(payload.Methods) == 0 && payload.JobType != "record" {
+		payload.Methods = config.StringList{"GET"}
+	}
+
+	errs = append(errs, files(payload)...)
+	errs = append(errs, regexps(payload)...)
+	errs = append(errs, urls(payload)...)
+	errs = append(errs, auths(payload)...)
+	errs = append(errs, writes(payload)...)
+	errs = append(errs, stubs(payload)...)
+	errs = append(errs, filter(payload)...)
+
+	// Catch runs that only compare auth failures unless told otherwise
+	if payload.Thresholds.MaxAuthFailureRate == nil {
+		maxAuthFailureRate := 0.5
+		payload.Thresholds.MaxAuthFailureRate = &maxAuthFailureRate
+	} else if rate := *payload.Thresholds.MaxAuthFailureRate; rate < 0 || rate > 1 {
+		errs = append(errs, fmt.Errorf("thresholds.max_auth_failure_rate must be between 0 and 1, got %v", rate))
+	}
+
+	if payload.Resume && payload.CheckpointLoc == "" {
+		errs = append(errs, fmt.Errorf("resume given but no checkpoint_loc"))
+	}
+	if payload.CheckpointInterval == 0 {
+		payload.CheckpointInterval = 60
+	} else if payload.CheckpointInterval < 0 {
+		errs = append(errs, fmt.Errorf("checkpoint_interval can't be negative, got %d", payload.CheckpointInterval))
+	}
+
+	if payload.Redact.HashKeyEnv != "" && os.Getenv(payload.Redact.HashKeyEnv) == "" {
+		errs = append(errs, fmt.Errorf("redact.hash_key_env given but %s is not set", payload.Redact.HashKeyEnv))
+	}
+
+	// If email set, need mandrill key
+	if payload.Email != "" && os.Getenv("MANDRILL_KEY") == "" {
+		errs = append(errs, fmt.Errorf("email given but no MANDRILL_KEY"))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	config.WeakCompare = payload.WeakCompare
+	config.IgnoredHeaders = payload.IgnoredHeaders
+	config.IgnoredBodyPaths = payload.IgnoredBodyPaths
+	config.RouteRules = payload.Routes
+	config.DiffSampleSize = payload.DiffSampleSize
+
+	return payload, nil
+}
+
+// Files validates the fields of the payload that pick which capture files are replayed
+func Files(payload *config.Payload) (*config.Payload, error) {
+	errs := []error{}
+	if payload.ServiceName == "" {
+		errs = append(errs, fmt.Errorf("Payload must contain 'service_name'"))
+	}
+	errs = append(errs, files(payload)...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
+	return payload, nil
+}
 
+func files(payload *config.Payload) []error {
+	errs := []error{}
 	// Set job_number and total_jobs to 1 if they are unset, return an error if one is set and the other not
 	if (payload.JobNumber == 0) != (payload.TotalJobs == 0) {
-		return nil, fmt.Errorf("Can't have JobNumber without TotalJobs and viceVersa: JobNumber %d, TotalJobs %d",
-			payload.JobNumber, payload.TotalJobs)
+		errs = append(errs, fmt.Errorf("Can't have JobNumber without TotalJobs and viceVersa: JobNumber %d, TotalJobs %d",
+			payload.JobNumber, payload.TotalJobs))
 	} else if payload.JobNumber == 0 {
 		payload.JobNumber = 1
 		payload.TotalJobs = 1
@@ -84,18 +174,267 @@ func Payload(payload *config.Payload) (*config.Payload, error) {
 	}
 	match, err := regexp.MatchString("^[0-9]{4}/[0-9]{2}/[0-9]{2}:[0-9]{2}$", payload.StartBefore)
 	if err != nil {
-		return nil, err
+		errs = append(errs, err)
 	} else if !match {
-		return nil, fmt.Errorf("start_before not in correct format. Expected 'yyyy/mm/dd:hh', got: %s", payload.StartBefore)
+		errs = append(errs, fmt.Errorf("start_before not in correct format. Expected 'yyyy/mm/dd:hh', got: %s", payload.StartBefore))
 	}
 
-	// If email set, need mandrill key
-	if payload.Email != "" && os.Getenv("MANDRILL_KEY") == "" {
-		return nil, fmt.Errorf("email given but no MANDRILL_KEY")
+	if payload.CaptureLoc == "" {
+		payload.CaptureLoc = fmt.Sprintf("s3://firehose-prod/replay-testing/%s/", payload.ServiceName)
+	} else if !strings.HasSuffix(payload.CaptureLoc, "/") {
+		payload.CaptureLoc += "/"
+	}
+	// Only recording can write captures locally, they can only be listed from s3
+	if payload.JobType != "record" && payload.HARFile == "" && !strings.HasPrefix(payload.CaptureLoc, "s3://") {
+		errs = append(errs, fmt.Errorf("capture_loc must be an s3 path, got %s", payload.CaptureLoc))
 	}
 
-	config.WeakCompare = payload.WeakCompare
-	config.IgnoredHeaders = payload.IgnoredHeaders
+	return errs
+}
 
-	return payload, nil
+// regexps checks the regexps, route rules, redactions and rewrites in the payload are usable
+func regexps(payload *config.Payload) []error {
+	errs := []error{}
+	for _, r := range payload.AllowURLRegex {
+		if _, err := regexp.Compile(r); err != nil {
+			errs = append(errs, fmt.Errorf("allow_url_regex %q is not a valid regex: %s", r, err))
+		}
+	}
+	for _, r := range payload.DisallowURLRegex {
+		if _, err := regexp.Compile(r); err != nil {
+			errs = append(errs, fmt.Errorf("disallow_url_regex %q is not a valid regex: %s", r, err))
+		}
+	}
+	for i, rule := range payload.Routes {
+		if rule.Route == "" {
+			errs = append(errs, fmt.Errorf("routes[%d] must contain 'route'", i))
+		}
+	}
+	for i, r := range payload.Redact.Patterns {
+		if _, err := regexp.Compile(r); err != nil {
+			errs = append(errs, fmt.Errorf("redact.patterns[%d] %q is not a valid regex: %s", i, r, err))
+		}
+	}
+	for _, rewrite := range []struct {
+		field   string
+		rewrite config.Rewrite
+	}{
+		{"rewrite", payload.Rewrite},
+		{"rewrite_control", payload.RewriteControl},
+		{"rewrite_experiment", payload.RewriteExperiment},
+	} {
+		for i, r := range rewrite.rewrite.ReplaceHeaders {
+			if r.Header == "" {
+				errs = append(errs, fmt.Errorf("%s.replace_headers[%d] must contain 'header'", rewrite.field, i))
+			}
+		}
+		for _, replaces := range []struct {
+			field    string
+			replaces []config.Replace
+		}{
+			{"replace_headers", rewrite.rewrite.ReplaceHeaders},
+			{"path", rewrite.rewrite.Path},
+			{"query", rewrite.rewrite.Query},
+		} {
+			for i, r := range replaces.replaces {
+				if _, err := regexp.Compile(r.Pattern); err != nil {
+					errs = append(errs, fmt.Errorf("%s.%s[%d].pattern %q is not a valid regex: %s", rewrite.field, replaces.field, i, r.Pattern, err))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// DefaultProductionPattern matches the hosts of production targets unless the payload has production_pattern
+const DefaultProductionPattern = `(^|[^a-z0-9])prod(uction)?([^a-z0-9]|$)`
+
+// writes checks that methods which aren't safe are only replayed when acknowledged with allow_writes,
+// and never to a production target
+func writes(payload *config.Payload) []error {
+	errs := []error{}
+	if payload.DryRunURL != "" && !payload.DryRun {
+		errs = append(errs, fmt.Errorf("dry_run_url given but not dry_run"))
+	}
+	if payload.DryRun && payload.DryRunURL == "" && payload.JobType == "load" {
+		// There is no experiment to fall back to, writes would be load tested against load_url
+		errs = append(errs, fmt.Errorf("dry_run needs dry_run_url if job_type is load"))
+	}
+	if payload.JobType == "record" {
+		return errs
+	}
+	if payload.ProductionPattern == "" {
+		payload.ProductionPattern = DefaultProductionPattern
+	}
+	production, err := regexp.Compile(payload.ProductionPattern)
+	if err != nil {
+		return append(errs, fmt.Errorf("production_pattern %q is not a valid regex: %s", payload.ProductionPattern, err))
+	}
+
+	unsafe := []string{}
+	for _, m := range payload.Methods {
+		if !config.IsSafeMethod(m) {
+			unsafe = append(unsafe, m)
+		}
+	}
+	if len(unsafe) == 0 {
+		return errs
+	}
+	if !payload.AllowWrites {
+		errs = append(errs, fmt.Errorf("methods %s aren't safe to replay, set allow_writes to replay them", strings.Join(unsafe, ",")))
+	}
+
+	// The targets writes are sent to. Dry runs only send them to dry_run_url, or the experiment
+	type target struct{ field, url string }
+	targets := []target{
+		{"control_url", payload.ControlURL},
+		{"control2_url", payload.Control2URL},
+		{"experiment_url", payload.ExperimentURL},
+		{"load_url", payload.LoadURL},
+	}
+	if payload.DryRun && payload.DryRunURL != "" {
+		targets = []target{{"dry_run_url", payload.DryRunURL}}
+	} else if payload.DryRun && payload.JobType == "correctness" {
+		targets = []target{{"experiment_url", payload.ExperimentURL}}
+	}
+	for _, target := range targets {
+		u, err := url.Parse(target.url)
+		if target.url == "" || err != nil {
+			continue
+		}
+		if production.MatchString(u.Hostname()) {
+			errs = append(errs, fmt.Errorf("%s %q matches production_pattern, writes can't be replayed to it", target.field, target.url))
+		}
+	}
+	return errs
+}
+
+// filter checks the filter's regexes compile and its sampling and rate limit make sense
+func filter(payload *config.Payload) []error {
+	errs := []error{}
+	f := payload.Filter
+	for _, headers := range []struct {
+		field   string
+		headers map[string]string
+	}{{"headers", f.Headers}, {"exclude_headers", f.ExcludeHeaders}} {
+		for h, r := range headers.headers {
+			if _, err := regexp.Compile(r); err != nil {
+				errs = append(errs, fmt.Errorf("filter.%s.%s %q is not a valid regex: %s", headers.field, h, r, err))
+			}
+		}
+	}
+	for _, r := range []struct{ field, regex string }{{"body_regex", f.BodyRegex}, {"user_agent_regex", f.UserAgentRegex}} {
+		if _, err := regexp.Compile(r.regex); err != nil {
+			errs = append(errs, fmt.Errorf("filter.%s %q is not a valid regex: %s", r.field, r.regex, err))
+		}
+	}
+	if f.SamplePercent < 0 || f.SamplePercent > 100 {
+		errs = append(errs, fmt.Errorf("filter.sample_percent must be between 0 and 100, got %v", f.SamplePercent))
+	}
+	if f.MaxRouteRate < 0 {
+		errs = append(errs, fmt.Errorf("filter.max_route_rate can't be negative, got %v", f.MaxRouteRate))
+	}
+	return errs
+}
+
+// stubs checks the stub server has something to serve and its stubs are usable
+func stubs(payload *config.Payload) []error {
+	errs := []error{}
+	hasStubs := len(payload.Stubs) > 0 || len(payload.StubFiles) > 0
+	if payload.StubAddr != "" && !hasStubs {
+		errs = append(errs, fmt.Errorf("stub_addr given but no stubs or stub_files"))
+	} else if payload.StubAddr == "" && hasStubs {
+		errs = append(errs, fmt.Errorf("stubs or stub_files given but no stub_addr"))
+	}
+	for i, st := range payload.Stubs {
+		for _, r := range []struct{ field, regex string }{{"url_regex", st.URLRegex}, {"body_regex", st.BodyRegex}} {
+			if _, err := regexp.Compile(r.regex); err != nil {
+				errs = append(errs, fmt.Errorf("stubs[%d].%s %q is not a valid regex: %s", i, r.field, r.regex, err))
+			}
+		}
+		if st.Status != 0 && (st.Status < 100 || st.Status > 599) {
+			errs = append(errs, fmt.Errorf("stubs[%d].status must be a valid HTTP status, got %d", i, st.Status))
+		}
+	}
+	return errs
+}
+
+// auths checks each auth config has exactly one source of credentials
+func auths(payload *config.Payload) []error {
+	errs := []error{}
+	for _, a := range []struct {
+		field string
+		auth  config.Auth
+	}{
+		{"auth", payload.Auth},
+		{"auth_control", payload.AuthControl},
+		{"auth_experiment", payload.AuthExperiment},
+	} {
+		sources := 0
+		for _, source := range []string{a.auth.Env, a.auth.File, a.auth.Command} {
+			if source != "" {
+				sources++
+			}
+		}
+		if sources > 1 {
+			errs = append(errs, fmt.Errorf("%s can only contain one of 'env', 'file' and 'command'", a.field))
+		} else if sources == 0 && a.auth != (config.Auth{}) {
+			errs = append(errs, fmt.Errorf("%s must contain 'env', 'file' or 'command'", a.field))
+		}
+		if a.auth.Env != "" && os.Getenv(a.auth.Env) == "" {
+			errs = append(errs, fmt.Errorf("%s.env given but %s is not set", a.field, a.auth.Env))
+		}
+		if a.auth.RefreshInterval < 0 {
+			errs = append(errs, fmt.Errorf("%s.refresh_interval can't be negative, got %d", a.field, a.auth.RefreshInterval))
+		}
+	}
+	return errs
+}
+
+// DefaultURLTemplate is how target URLs are built from envs unless the payload has url_template
+const DefaultURLTemplate = "https://{env}--{service}{pod}.int.clever.com:{port}"
+
+// targetURL builds the URL of a target from the payload's url_template
+func targetURL(payload *config.Payload, env, port string) string {
+	if payload.URLTemplate == "" {
+		payload.URLTemplate = DefaultURLTemplate
+	}
+	podID := ""
+	if payload.PodID != "" {
+		podID = fmt.Sprintf("--%s", payload.PodID)
+	}
+	return strings.NewReplacer(
+		"{env}", env,
+		"{service}", payload.ServiceName,
+		"{pod}", podID,
+		"{port}", port,
+	).Replace(payload.URLTemplate)
+}
+
+// urls checks the target URLs are ones we can forward to
+func urls(payload *config.Payload) []error {
+	errs := []error{}
+	for _, target := range []struct{ field, url string }{
+		{"control_url", payload.ControlURL},
+		{"control2_url", payload.Control2URL},
+		{"experiment_url", payload.ExperimentURL},
+		{"load_url", payload.LoadURL},
+		{"record_url", payload.RecordURL},
+		{"dry_run_url", payload.DryRunURL},
+	} {
+		if target.url == "" {
+			continue
+		}
+		u, err := url.Parse(target.url)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %q is not a valid URL: %s", target.field, target.url, err))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s %q must be http(s)://host[:port]", target.field, target.url))
+		} else if target.field != "record_url" && (strings.Trim(u.Path, "/") != "" || u.RawQuery != "") {
+			// Replayed requests keep their recorded path, only the record proxy uses the URL's path
+			errs = append(errs, fmt.Errorf("%s %q can't have a path or query, requests keep their own. Use rewrite path to change them",
+				target.field, target.url))
+		}
+	}
+	return errs
 }
@@ -0,0 +1,259 @@
+package validate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Clever/http-science/config"
+)
+
+func TestPayloadDefaults(t *testing.T) {
+	payload, err := Payload(&config.Payload{
+		JobType:       "correctness",
+		ServiceName:   "my-service",
+		ControlEnv:    "master",
+		ExperimentEnv: "branch",
+		DiffLoc:       "/tmp/diffs",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://master--my-service.int.clever.com:443", payload.ControlURL)
+	assert.Equal(t, "https://branch--my-service.int.clever.com:443", payload.ExperimentURL)
+	assert.Equal(t, config.StringList{"GET"}, payload.Methods)
+	assert.Equal(t, 1000, payload.Reqs)
+	assert.Equal(t, 1, payload.JobNumber)
+	assert.Equal(t, "s3://firehose-prod/replay-testing/my-service/", payload.CaptureLoc)
+}
+
+func TestPayloadReportsEveryProblem(t *testing.T) {
+	_, err := Payload(&config.Payload{
+		JobType:       "correctness",
+		ExperimentEnv: "branch",
+		JobNumber:     2,
+		StartBefore:   "yesterday",
+		AllowURLRegex: config.StringList{"("},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 6, len(strings.Split(err.Error(), "\n")))
+}
+
+func TestPayloadDiffUpload(t *testing.T) {
+	_, err := Payload(&config.Payload{
+		JobType:            "correctness",
+		ServiceName:        "my-service",
+		ControlURL:         "http://localhost:8080",
+		ExperimentURL:      "http://localhost:8081",
+		DiffLoc:            "/tmp/diffs",
+		DiffUploadInterval: -1,
+		DiffChunkBytes:     -1,
+	})
+	assert.EqualError(t, err, "diff_upload_interval can't be negative, got -1\ndiff_chunk_bytes can't be negative, got -1")
+}
+
+func TestPayloadCheckpoint(t *testing.T) {
+	_, err := Payload(&config.Payload{
+		JobType:            "load",
+		ServiceName:        "my-service",
+		LoadURL:            "http://localhost:8080",
+		CheckpointLoc:      "/tmp/checkpoint.json",
+		CheckpointInterval: -1,
+	})
+	assert.EqualError(t, err, "checkpoint_interval can't be negative, got -1")
+}
+
+func TestPayloadURLs(t *testing.T) {
+	payload, err := Payload(&config.Payload{
+		JobType:       "correctness",
+		ServiceName:   "my-service",
+		ControlURL:    "http://localhost:8080",
+		ExperimentEnv: "branch",
+		Port:          "8443",
+		PodID:         "abc",
+		URLTemplate:   "https://{service}-{env}{pod}.staging.example.com:{port}",
+		DiffLoc:       "/tmp/diffs",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "http://localhost:8080", payload.ControlURL)
+	assert.Equal(t, "https://my-service-branch--abc.staging.example.com:8443", payload.ExperimentURL)
+
+	_, err = Payload(&config.Payload{
+		JobType:     "load",
+		ServiceName: "my-service",
+		LoadURL:     "localhost:8080",
+	})
+	assert.EqualError(t, err, `load_url "localhost:8080" must be http(s)://host[:port]`)
+
+	_, err = Payload(&config.Payload{
+		JobType:     "load",
+		ServiceName: "my-service",
+		LoadURL:     "https://alb.example.com/api",
+	})
+	assert.EqualError(t, err, `load_url "https://alb.example.com/api" can't have a path or query, requests keep their own. Use rewrite path to change them`)
+}
+
+func TestPayloadRecord(t *testing.T) {
+	payload, err := Payload(&config.Payload{
+		JobType:     "record",
+		ServiceName: "my-service",
+		RecordURL:   "http://localhost:8080",
+		CaptureLoc:  "/tmp/captures",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/tmp/captures/", payload.CaptureLoc)
+	assert.Equal(t, 1.0, payload.RecordSampleRate)
+	assert.Equal(t, ":8080", payload.ListenAddr)
+	assert.Equal(t, 0, len(payload.Methods))
+
+	// Captures can only be replayed from s3
+	_, err = Payload(&config.Payload{
+		JobType:     "load",
+		ServiceName: "my-service",
+		LoadEnv:     "master",
+		CaptureLoc:  "/tmp/captures",
+	})
+	assert.EqualError(t, err, "capture_loc must be an s3 path, got /tmp/captures/")
+}
+
+func TestPayloadRewrite(t *testing.T) {
+	_, err := Payload(&config.Payload{
+		JobType:     "load",
+		ServiceName: "my-service",
+		LoadEnv:     "master",
+		RewriteExperiment: config.Rewrite{
+			ReplaceHeaders: []config.Replace{{Pattern: "a"}},
+			Query:          []config.Replace{{Pattern: "("}},
+		},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{
+		"rewrite_experiment.replace_headers[0] must contain 'header'",
+		"rewrite_experiment.query[0].pattern \"(\" is not a valid regex: error parsing regexp: missing closing ): `(`",
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestPayloadAuth(t *testing.T) {
+	payload, err := Payload(&config.Payload{JobType: "load", ServiceName: "my-service", LoadEnv: "master"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0.5, *payload.Thresholds.MaxAuthFailureRate)
+
+	_, err = Payload(&config.Payload{
+		JobType:        "load",
+		ServiceName:    "my-service",
+		LoadEnv:        "master",
+		Auth:           config.Auth{Env: "HTTP_SCIENCE_TEST_UNSET", File: "/tmp/token"},
+		AuthControl:    config.Auth{Prefix: "Bearer "},
+		AuthExperiment: config.Auth{Command: "cat /tmp/token", RefreshInterval: -1},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{
+		"auth can only contain one of 'env', 'file' and 'command'",
+		"auth.env given but HTTP_SCIENCE_TEST_UNSET is not set",
+		"auth_control must contain 'env', 'file' or 'command'",
+		"auth_experiment.refresh_interval can't be negative, got -1",
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestPayloadRedact(t *testing.T) {
+	_, err := Payload(&config.Payload{
+		JobType:     "load",
+		ServiceName: "my-service",
+		LoadEnv:     "master",
+		Redact:      config.Redact{Patterns: []string{"[a-z"}, HashKeyEnv: "HTTP_SCIENCE_TEST_UNSET"},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{
+		"redact.patterns[0] \"[a-z\" is not a valid regex: error parsing regexp: missing closing ]: `[a-z`",
+		"redact.hash_key_env given but HTTP_SCIENCE_TEST_UNSET is not set",
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestPayloadWrites(t *testing.T) {
+	correctness := func() *config.Payload {
+		return &config.Payload{
+			JobType:       "correctness",
+			ServiceName:   "my-service",
+			ControlEnv:    "production",
+			ExperimentEnv: "my-branch",
+			DiffLoc:       "s3://bucket/diffs",
+			Methods:       config.StringList{"GET", "post", "DELETE"},
+		}
+	}
+
+	_, err := Payload(correctness())
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{
+		"methods post,DELETE aren't safe to replay, set allow_writes to replay them",
+		`control_url "https://production--my-service.int.clever.com:443" matches production_pattern, writes can't be replayed to it`,
+	}, strings.Split(err.Error(), "\n"))
+
+	// Dry runs don't send writes to the control
+	p := correctness()
+	p.AllowWrites, p.DryRun = true, true
+	_, err = Payload(p)
+	assert.Nil(t, err)
+
+	p = correctness()
+	p.AllowWrites, p.DryRunURL = true, "https://prod-stub.example.com"
+	_, err = Payload(p)
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{
+		"dry_run_url given but not dry_run",
+		`control_url "https://production--my-service.int.clever.com:443" matches production_pattern, writes can't be replayed to it`,
+	}, strings.Split(err.Error(), "\n"))
+
+	p = correctness()
+	p.AllowWrites, p.ProductionPattern = true, "^live--"
+	_, err = Payload(p)
+	assert.Nil(t, err)
+
+	// Safe methods don't need allow_writes, even to production
+	p = correctness()
+	p.Methods = config.StringList{"GET", "HEAD"}
+	_, err = Payload(p)
+	assert.Nil(t, err)
+	// Load tests have no experiment to send dry run writes to
+	load := &config.Payload{JobType: "load", ServiceName: "my-service", LoadURL: "https://staging.example.com", DryRun: true}
+	_, err = Payload(load)
+	assert.EqualError(t, err, "dry_run needs dry_run_url if job_type is load")
+	load.DryRunURL = "https://stub.example.com"
+	_, err = Payload(load)
+	assert.Nil(t, err)
+}
+
+func TestPayloadStubs(t *testing.T) {
+	_, err := Payload(&config.Payload{JobType: "load", ServiceName: "my-service", LoadEnv: "master", StubAddr: ":9000"})
+	assert.EqualError(t, err, "stub_addr given but no stubs or stub_files")
+
+	_, err = Payload(&config.Payload{
+		JobType:     "load",
+		ServiceName: "my-service",
+		LoadEnv:     "master",
+		Stubs:       []config.Stub{{URLRegex: "(", Status: 1000}},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{
+		"stubs or stub_files given but no stub_addr",
+		"stubs[0].url_regex \"(\" is not a valid regex: error parsing regexp: missing closing ): `(`",
+		"stubs[0].status must be a valid HTTP status, got 1000",
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestPayloadFilter(t *testing.T) {
+	_, err := Payload(&config.Payload{
+		JobType:     "load",
+		ServiceName: "my-service",
+		LoadEnv:     "master",
+		Filter: config.Filter{
+			Headers:       map[string]string{"X-Version": "["},
+			SamplePercent: 150,
+			MaxRouteRate:  -1,
+		},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{
+		"filter.headers.X-Version \"[\" is not a valid regex: error parsing regexp: missing closing ]: `[`",
+		"filter.sample_percent must be between 0 and 100, got 150",
+		"filter.max_route_rate can't be negative, got -1",
+	}, strings.Split(err.Error(), "\n"))
+}